@@ -0,0 +1,59 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+)
+
+// write the latest version of the database to w as a database file of its own.
+// the version is pinned like a reader's, so writers and readers keep going meanwhile.
+func (db *KV) Backup(w io.Writer) error {
+	reader, err := db.BeginRead()
+	if err != nil {
+		return err
+	}
+	defer reader.EndRead()
+	master := reader.master
+	if master.txid == 0 {
+		return nil // nothing committed yet, an empty file is an empty database
+	}
+	// a master page with a single slot, the live one might be changing
+	page := make([]byte, BTREE_PAGE_SIZE)
+	slot := masterEncode(master)
+	copy(page[(master.txid%2)*MASTER_SLOT_OFFSET:], slot[:])
+	if db.crypt.aead != nil {
+		kcv, err := kcvEncode(db.crypt.aead)
+		if err != nil {
+			return fmt.Errorf("Backup: %w", err)
+		}
+		copy(page[MASTER_KCV_OFFSET:], kcv)
+	}
+	if err := backupPage(db, w, 0, page); err != nil {
+		return fmt.Errorf("Backup: %w", err)
+	}
+	// followed by the pages of the version as they are, encrypted again with a key
+	for ptr := uint64(1); ptr < master.used; ptr++ {
+		page, ok := walLookup(db, reader.wal, ptr)
+		if !ok {
+			if page, err = reader.store.Read(ptr); err != nil {
+				return fmt.Errorf("Backup: %w", err)
+			}
+		}
+		if err := backupPage(db, w, ptr, page); err != nil {
+			return fmt.Errorf("Backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// write a page in the file format of the database
+func backupPage(db *KV, w io.Writer, ptr uint64, page []byte) error {
+	if db.crypt.aead != nil {
+		var err error
+		if page, err = cryptEncode(db.crypt.aead, ptr, page); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(page)
+	return err
+}
@@ -0,0 +1,77 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// backups taken while the writer keeps updating are consistent files
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := &KV{Path: filepath.Join(dir, "db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil || buf.Len() != 0 {
+		t.Fatal("empty file", err, buf.Len())
+	}
+	for i := 0; i < 3000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{'a'}, i%200+i%7*2000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			k := []byte(fmt.Sprintf("k%05d", i%3000))
+			var err error
+			if i%2 == 0 {
+				_, err = db.Del(k)
+			} else {
+				err = db.Set(k, bytes.Repeat([]byte{'b'}, i%5000))
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for n := 0; n < 5; n++ {
+		buf.Reset()
+		if err := db.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprint("backup", n))
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bak := &KV{Path: path}
+		if err := bak.Open(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := bak.Verify()
+		if err != nil || !res.OK() {
+			t.Fatal(err, res.Errors)
+		}
+		if err := bak.Set([]byte("x"), []byte("y")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bak.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,7 +3,6 @@ package btree
 import (
 	"encoding/binary"
 	"fmt"
-	"unsafe"
 
 	"github.com/abedmohammed/goDB/utils"
 )
@@ -21,22 +20,28 @@ const (
 type BTree struct {
 	root uint64 // disk page number
 	// callbacks to manage disk page references
-	get func(uint64) BNode // to derefrence pointer
-	new func(BNode) uint64 // to allocate new page
-	del func(uint64)       // to deallocate new page
+	get func(uint64) (BNode, error) // to derefrence pointer
+	new func(BNode) (uint64, error) // to allocate new page
+	del func(uint64) error          // to deallocate new page
 }
 
 const HEADER = 4
 
 const BTREE_PAGE_SIZE = 4096
 
+// the last bytes of a page are reserved for its checksum,
+// a node must fit in the rest.
+const PAGE_TRAILER = 4
+const BTREE_NODE_SIZE = BTREE_PAGE_SIZE - PAGE_TRAILER
+
 // size constraints
 const BTREE_MAX_KEY_SIZE = 1000
-const BTREE_MAX_VAL_SIZE = 3000
+const BTREE_MAX_VAL_SIZE = 3000        // larger values are kept in overflow pages
+const BTREE_MAX_BIG_VAL_SIZE = 1 << 30 // the limit for those
 
 func init() {
 	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	utils.Assert(node1max > BTREE_PAGE_SIZE, "Exceeded page size!")
+	utils.Assert(node1max > BTREE_NODE_SIZE, "Exceeded page size!")
 }
 
 // header functions
@@ -114,7 +119,7 @@ func (node BNode) getVal(idx uint16) []byte {
 
 	pos := node.kvPos(idx) // byte position of kv-pair
 	klen := binary.LittleEndian.Uint16(node.data[pos:])
-	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node.data[pos+2:]) &^ VAL_REF
 	return node.data[pos+4+klen:][:vlen]
 }
 
@@ -127,55 +132,75 @@ func (node BNode) nbytes() uint16 {
 type C struct {
 	tree  BTree
 	ref   map[string]string // reference map to record each b-tree update
-	pages map[uint64]BNode  // hashmap to hold pages in-memory, no disk persistence yet
+	store PageStore         // the pages, in memory without disk persistence
+	pages map[uint64]bool   // the pages in use
 }
 
 func NewC() *C {
-	pages := map[uint64]BNode{}
-	return &C{
-		tree: BTree{
-			get: func(ptr uint64) BNode {
-				node, ok := pages[ptr]
-				utils.Assert(!ok, "Note not found in pages!")
-
-				return node
-			},
-			new: func(node BNode) uint64 {
-				utils.Assert(node.nbytes() > BTREE_PAGE_SIZE, "Node too large!")
-
-				key := uint64(uintptr(unsafe.Pointer(&node.data[0])))
-				utils.Assert(pages[key].data != nil, "Data at key is not null")
-
-				pages[key] = node
-				return key
-			},
-			del: func(ptr uint64) {
-				_, ok := pages[ptr]
-				utils.Assert(!ok, "Note not found in pages!")
-
-				delete(pages, ptr)
-			},
-		},
+	c := &C{
 		ref:   map[string]string{},
-		pages: pages,
+		store: NewMemStore(),
+		pages: map[uint64]bool{},
+	}
+	next := uint64(1) // the next page to allocate, 0 is the null pointer
+	c.tree = BTree{
+		get: func(ptr uint64) (BNode, error) {
+			if !c.pages[ptr] {
+				return BNode{}, fmt.Errorf("%w: page %d not found", ErrCorruptPage, ptr)
+			}
+			page, err := c.store.Read(ptr)
+			return BNode{page}, err
+		},
+		new: func(node BNode) (uint64, error) {
+			utils.Assert(node.nbytes() > BTREE_NODE_SIZE, "Node too large!")
+
+			ptr := next
+			next++
+			if err := c.store.Grow(next); err != nil {
+				return 0, err
+			}
+			page := make([]byte, BTREE_PAGE_SIZE)
+			copy(page, node.data)
+			if err := c.store.Write(ptr, page); err != nil {
+				return 0, err
+			}
+			c.pages[ptr] = true
+			return ptr, nil
+		},
+		del: func(ptr uint64) error {
+			if !c.pages[ptr] {
+				return fmt.Errorf("%w: page %d not found", ErrCorruptPage, ptr)
+			}
+			delete(c.pages, ptr)
+			return nil
+		},
 	}
+	return c
 }
 
-func (c *C) Add(key string, val string) {
-	c.tree.Insert([]byte(key), []byte(val))
+func (c *C) Add(key string, val string) error {
+	if err := c.tree.Insert([]byte(key), []byte(val)); err != nil {
+		return err
+	}
 	c.ref[key] = val
+	return nil
 }
 
-func (c *C) Del(key string) bool {
+func (c *C) Del(key string) (bool, error) {
+	deleted, err := c.tree.Delete([]byte(key))
+	if err != nil {
+		return false, err
+	}
 	delete(c.ref, key)
-	return c.tree.Delete([]byte(key))
+	return deleted, nil
 }
 
 func (c *C) PrintTree() {
 	// fmt.Printf("Root page: %d\n", c.pages[c.tree.root])
 	fmt.Println("Pages:")
-	for pt, node := range c.pages {
+	for pt := range c.pages {
+		page, _ := c.store.Read(pt)
 		fmt.Println("Pointer:", pt)
-		fmt.Println("BNode data:", node.data)
+		fmt.Println("BNode data:", page)
 	}
 }
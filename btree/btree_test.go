@@ -0,0 +1,150 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// compare the tree with the reference map, by lookups and by iterating both ways
+func btreeCheck(t *testing.T, c *C) {
+	keys := []string{}
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok, err := c.tree.Get([]byte(k))
+		if err != nil || !ok || string(v) != c.ref[k] {
+			t.Fatalf("get %q: %v", k, err)
+		}
+	}
+	i := 0
+	for it := c.tree.SeekGE(nil); it.Valid(); it.Next() {
+		k, v := it.Deref()
+		if i >= len(keys) || string(k) != keys[i] || string(v) != c.ref[keys[i]] {
+			t.Fatalf("next %d: %q", i, k)
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatal("next count", i, len(keys))
+	}
+	i = len(keys) - 1
+	for it := c.tree.SeekLE([]byte("\xff")); it.Valid(); it.Prev() {
+		k, _ := it.Deref()
+		if i < 0 || string(k) != keys[i] {
+			t.Fatalf("prev %d: %q", i, k)
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatal("prev count", len(keys)-1-i, len(keys))
+	}
+	// seeking between two keys
+	if len(keys) > 0 {
+		key := keys[len(keys)/2] + "\x00"
+		it := c.tree.SeekGE([]byte(key))
+		if j := sort.SearchStrings(keys, key); j < len(keys) {
+			if k, _ := it.Deref(); !it.Valid() || string(k) != keys[j] {
+				t.Fatalf("seek %q: %q", key, k)
+			}
+		} else if it.Valid() {
+			t.Fatalf("seek %q past the end", key)
+		}
+	}
+}
+
+func TestBTree(t *testing.T) {
+	c := NewC()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("k%08d", r.Intn(100000))
+		v := string(bytes.Repeat([]byte{'v'}, r.Intn(200)))
+		if r.Intn(8) == 0 {
+			v = string(bytes.Repeat([]byte{'V'}, r.Intn(3000)))
+		}
+		var err error
+		if r.Intn(3) == 0 {
+			_, err = c.Del(k)
+		} else {
+			err = c.Add(k, v)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2000 == 0 {
+			btreeCheck(t, c)
+		}
+	}
+	btreeCheck(t, c)
+	for k := range c.ref {
+		if ok, err := c.Del(k); err != nil || !ok {
+			t.Fatal("del", k, err)
+		}
+	}
+	btreeCheck(t, c)
+}
+
+// nodes of large keys and values are split in 3
+func TestBTreeSplit(t *testing.T) {
+	for seed := int64(0); seed < 30; seed++ {
+		c := NewC()
+		r := rand.New(rand.NewSource(seed))
+		for i := 0; i < 5000; i++ {
+			k := fmt.Sprintf("k%08d", r.Intn(3000)) + string(bytes.Repeat([]byte{'k'}, r.Intn(990)))
+			v := string(bytes.Repeat([]byte{'V'}, r.Intn(3001)))
+			var err error
+			if r.Intn(3) == 0 {
+				_, err = c.Del(k)
+			} else {
+				err = c.Add(k, v)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		btreeCheck(t, c)
+		for ptr := range c.pages {
+			node, err := c.tree.get(ptr)
+			if err != nil || node.nbytes() > BTREE_NODE_SIZE {
+				t.Fatal("bad node", ptr, err)
+			}
+		}
+	}
+}
+
+// seeking before the first key and past the last key
+func TestBIterBounds(t *testing.T) {
+	c := NewC()
+	if c.tree.SeekGE(nil).Valid() || c.tree.SeekLE([]byte("\xff")).Valid() {
+		t.Fatal("empty tree")
+	}
+	for i := 1; i <= 3000; i++ {
+		if err := c.Add(fmt.Sprintf("k%05d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if it := c.tree.SeekLE([]byte("k00000")); it.Valid() {
+		t.Fatal("before the first key")
+	}
+	if it := c.tree.SeekGE([]byte("k03000\x00")); it.Valid() {
+		t.Fatal("past the last key")
+	}
+	it := c.tree.SeekGE([]byte("k00001"))
+	if k, _ := it.Deref(); string(k) != "k00001" {
+		t.Fatalf("first key %q", k)
+	}
+	if it.Prev(); it.Valid() {
+		t.Fatal("prev of the first key")
+	}
+	it = c.tree.SeekLE([]byte("\xff"))
+	if k, _ := it.Deref(); string(k) != "k03000" {
+		t.Fatalf("last key %q", k)
+	}
+	if it.Next(); it.Valid() {
+		t.Fatal("next of the last key")
+	}
+}
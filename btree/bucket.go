@@ -0,0 +1,372 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// a bucket is a named keyspace with a B-tree of its own, next to the main tree.
+// the catalog is a B-tree from the bucket names to the roots of their trees,
+// and the master page points to it. the trees share the pages and the free list,
+// so a transaction commits the updates of all of them at once.
+//
+// the catalog value format, the root is 0 for an empty bucket.
+// | root |
+// |  8B  |
+const CATALOG_VAL_SIZE = 8
+
+// the root of a bucket
+func catalogGet(catalog *BTree, name []byte) (uint64, error) {
+	if err := checkKey(name); err != nil {
+		return 0, err
+	}
+	val, ok, err := catalog.Get(name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrBucketNotFound, name)
+	}
+	if len(val) != CATALOG_VAL_SIZE {
+		return 0, fmt.Errorf("%w: bad catalog entry %q", ErrCorruptPage, name)
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
+
+// record the root of a bucket
+func catalogSet(catalog *BTree, name []byte, root uint64) error {
+	return catalog.Insert(name, binary.LittleEndian.AppendUint64(nil, root))
+}
+
+// the tree of a bucket, it uses the page callbacks of the catalog
+func bucketTree(catalog *BTree, root uint64) *BTree {
+	return &BTree{root: root, get: catalog.get, new: catalog.new, del: catalog.del}
+}
+
+// deallocate the subtree at ptr, with the overflow pages of its values
+func treeFree(tree *BTree, ptr uint64) error {
+	node, err := tree.get(ptr)
+	if err != nil {
+		return err
+	}
+	btype := node.btype()
+	if btype != BNODE_LEAF && btype != BNODE_NODE {
+		return fmt.Errorf("%w: bad node type %d", ErrCorruptPage, btype)
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if btype == BNODE_NODE {
+			err = treeFree(tree, node.getPtr(i))
+		} else if node.isValRef(i) {
+			err = overflowFree(tree, node.getVal(i))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tree.del(ptr)
+}
+
+// create an empty bucket
+func (tx *KVTX) CreateBucket(name []byte) error {
+	if err := txCheck(tx); err != nil {
+		return err
+	}
+	_, err := catalogGet(&tx.db.catalog, name)
+	if err == nil {
+		return fmt.Errorf("%w: %q", ErrBucketExists, name)
+	}
+	if !errors.Is(err, ErrBucketNotFound) {
+		return err
+	}
+	if err := catalogSet(&tx.db.catalog, name, 0); err != nil {
+		tx.err = err
+		return err
+	}
+	return nil
+}
+
+// delete a bucket with all its keys
+func (tx *KVTX) DeleteBucket(name []byte) error {
+	if err := txCheck(tx); err != nil {
+		return err
+	}
+	root, err := catalogGet(&tx.db.catalog, name)
+	if err != nil {
+		return err
+	}
+	if root != 0 {
+		err = treeFree(bucketTree(&tx.db.catalog, root), root)
+	}
+	if err == nil {
+		_, err = tx.db.catalog.Delete(name)
+	}
+	if err != nil {
+		tx.err = err
+	}
+	return err
+}
+
+// a bucket to read and update in the transaction
+func (tx *KVTX) Bucket(name []byte) (*BucketTX, error) {
+	if err := txCheck(tx); err != nil {
+		return nil, err
+	}
+	if _, err := catalogGet(&tx.db.catalog, name); err != nil {
+		return nil, err
+	}
+	return &BucketTX{tx: tx, name: bytes.Clone(name)}, nil
+}
+
+// a bucket in a write transaction, it can't be used after the transaction ends
+type BucketTX struct {
+	tx   *KVTX
+	name []byte
+}
+
+// the tree of the bucket, the root is looked up as the tx might have changed it
+func (b *BucketTX) tree() (*BTree, error) {
+	if err := txCheck(b.tx); err != nil {
+		return nil, err
+	}
+	root, err := catalogGet(&b.tx.db.catalog, b.name)
+	if err != nil {
+		return nil, err
+	}
+	return bucketTree(&b.tx.db.catalog, root), nil
+}
+
+// record the root of the bucket after an update
+func (b *BucketTX) update(tree *BTree, root uint64, err error) error {
+	if err == nil && tree.root != root {
+		err = catalogSet(&b.tx.db.catalog, b.name, tree.root)
+	}
+	if err != nil {
+		b.tx.err = err
+	}
+	return err
+}
+
+// read the bucket, including the updates of the tx
+func (b *BucketTX) Get(key []byte) ([]byte, bool, error) {
+	tree, err := b.tree()
+	if err != nil {
+		return nil, false, err
+	}
+	return tree.Get(key)
+}
+
+// iterate over the keys in [start, end) of the bucket, including the updates of the tx
+func (b *BucketTX) Scan(start []byte, end []byte) *KVIter {
+	tree, err := b.tree()
+	if err != nil {
+		return &KVIter{iter: &BIter{err: err}}
+	}
+	return &KVIter{iter: tree.SeekGE(start), end: end}
+}
+
+// update the bucket
+func (b *BucketTX) Set(key []byte, val []byte) error {
+	tree, err := b.tree()
+	if err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := checkVal(val); err != nil {
+		return err
+	}
+	root := tree.root
+	return b.update(tree, root, tree.Insert(key, val))
+}
+
+// update the bucket depending on the mode of the request, see BTree.Update
+func (b *BucketTX) Update(req *UpdateReq) (bool, error) {
+	tree, err := b.tree()
+	if err != nil {
+		return false, err
+	}
+	if err := checkUpdate(req); err != nil {
+		return false, err
+	}
+	root := tree.root
+	updated, err := tree.Update(req)
+	return updated, b.update(tree, root, err)
+}
+
+func (b *BucketTX) Del(key []byte) (bool, error) {
+	tree, err := b.tree()
+	if err != nil {
+		return false, err
+	}
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	root := tree.root
+	deleted, err := tree.Delete(key)
+	return deleted, b.update(tree, root, err)
+}
+
+// a bucket in a snapshot
+func (reader *KVReader) Bucket(name []byte) (*BucketReader, error) {
+	if reader.done {
+		return nil, ErrTxDone
+	}
+	root, err := catalogGet(&reader.catalog, name)
+	if err != nil {
+		return nil, err
+	}
+	return &BucketReader{reader: reader, tree: bucketTree(&reader.catalog, root)}, nil
+}
+
+// a bucket in a read-only snapshot, it can't be used after EndRead
+type BucketReader struct {
+	reader *KVReader
+	tree   *BTree
+}
+
+// read the snapshot of the bucket
+func (b *BucketReader) Get(key []byte) ([]byte, bool, error) {
+	if b.reader.done {
+		return nil, false, ErrTxDone
+	}
+	return b.tree.Get(key)
+}
+
+// iterate over the keys in [start, end) of the snapshot of the bucket
+func (b *BucketReader) Scan(start []byte, end []byte) *KVIter {
+	if b.reader.done {
+		return &KVIter{iter: &BIter{err: ErrTxDone}}
+	}
+	return &KVIter{iter: b.tree.SeekGE(start), end: end}
+}
+
+// create an empty bucket in a transaction of its own
+func (db *KV) CreateBucket(name []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.CreateBucket(name); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// delete a bucket with all its keys in a transaction of its own
+func (db *KV) DeleteBucket(name []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.DeleteBucket(name); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// a bucket that exists now, see Bucket
+func (db *KV) Bucket(name []byte) (*Bucket, error) {
+	reader, err := db.BeginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.EndRead()
+	if _, err := reader.Bucket(name); err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, name: bytes.Clone(name)}, nil
+}
+
+// a bucket of the database. like the KV methods, each call runs in a transaction
+// or a snapshot of its own, and fails with ErrBucketNotFound once it's deleted.
+type Bucket struct {
+	db   *KV
+	name []byte
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, bool, error) {
+	reader, err := b.db.BeginRead()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.EndRead()
+	rb, err := reader.Bucket(b.name)
+	if err != nil {
+		return nil, false, err
+	}
+	val, ok, err := rb.Get(key)
+	// the page can be reused once the reader is gone
+	return bytes.Clone(val), ok, err
+}
+
+// iterate over the keys in [start, end) of the latest version of the bucket.
+// the version is pinned until the iterator is closed.
+func (b *Bucket) Scan(start []byte, end []byte) *KVIter {
+	reader, err := b.db.BeginRead()
+	if err != nil {
+		return &KVIter{iter: &BIter{err: err}}
+	}
+	rb, err := reader.Bucket(b.name)
+	if err != nil {
+		reader.EndRead()
+		return &KVIter{iter: &BIter{err: err}}
+	}
+	iter := rb.Scan(start, end)
+	iter.reader = reader
+	return iter
+}
+
+func (b *Bucket) Set(key []byte, val []byte) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	tb, err := tx.Bucket(b.name)
+	if err == nil {
+		err = tb.Set(key, val)
+	}
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *Bucket) Update(req *UpdateReq) (bool, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	tb, err := tx.Bucket(b.name)
+	updated := false
+	if err == nil {
+		updated, err = tb.Update(req)
+	}
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return updated, tx.Commit()
+}
+
+func (b *Bucket) Del(key []byte) (bool, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	tb, err := tx.Bucket(b.name)
+	deleted := false
+	if err == nil {
+		deleted, err = tb.Del(key)
+	}
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return deleted, tx.Commit()
+}
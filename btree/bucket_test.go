@@ -0,0 +1,279 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compare the buckets with their reference maps
+func bucketCheck(t *testing.T, db *KV, refs map[string]map[string]string) {
+	t.Helper()
+	for name, ref := range refs {
+		b, err := db.Bucket([]byte(name))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for k, v := range ref {
+			got, ok, err := b.Get([]byte(k))
+			if err != nil || !ok || string(got) != v {
+				t.Fatal(name, k, ok, err, len(got), len(v))
+			}
+		}
+		n := 0
+		it := b.Scan(nil, nil)
+		for ; it.Valid(); it.Next() {
+			k, v := it.Deref()
+			if ref[string(k)] != string(v) {
+				t.Fatal("scan", name, string(k))
+			}
+			n++
+		}
+		it.Close()
+		if n != len(ref) {
+			t.Fatal("scan count", name, n, len(ref))
+		}
+	}
+	res, err := db.Verify()
+	if err != nil || !res.OK() || res.Buckets != len(refs) {
+		t.Fatal(err, res.Errors, res.Buckets, len(refs))
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	for _, opt := range []Options{{}, {WAL: true}, {Key: make([]byte, 16), WAL: true, CacheSize: 1 << 16}} {
+		path := filepath.Join(t.TempDir(), "db")
+		db := &KV{Path: path, Options: opt}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set([]byte("main"), []byte("m")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Bucket([]byte("users")); !errors.Is(err, ErrBucketNotFound) {
+			t.Fatal(err)
+		}
+		for _, n := range []string{"users", "sessions", "events"} {
+			if err := db.CreateBucket([]byte(n)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.CreateBucket([]byte("users")); !errors.Is(err, ErrBucketExists) {
+			t.Fatal(err)
+		}
+		if err := db.CreateBucket(nil); !errors.Is(err, ErrEmptyKey) {
+			t.Fatal(err)
+		}
+		refs := map[string]map[string]string{"users": {}, "sessions": {}, "events": {}}
+		r := rand.New(rand.NewSource(1))
+		names := []string{"users", "sessions", "events"}
+		for i := 0; i < 300; i++ {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending := map[string]map[string]string{}
+			for j := 0; j < 10; j++ {
+				n := names[r.Intn(3)]
+				b, err := tx.Bucket([]byte(n))
+				if err != nil {
+					t.Fatal(err)
+				}
+				k := fmt.Sprintf("k%04d", r.Intn(300))
+				if pending[n] == nil {
+					pending[n] = map[string]string{}
+				}
+				if r.Intn(4) == 0 {
+					if _, err := b.Del([]byte(k)); err != nil {
+						t.Fatal(err)
+					}
+					pending[n][k] = "\x00del"
+				} else {
+					v := strings.Repeat(n, r.Intn(2000))
+					if err := b.Set([]byte(k), []byte(v)); err != nil {
+						t.Fatal(err)
+					}
+					pending[n][k] = v
+				}
+				// the keys of the main tree are apart
+				if _, ok, _ := tx.Get([]byte(k)); ok {
+					t.Fatal("bucket key in the main tree", k)
+				}
+			}
+			if r.Intn(5) == 0 {
+				tx.Abort()
+				continue
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			for n, m := range pending {
+				for k, v := range m {
+					if v == "\x00del" {
+						delete(refs[n], k)
+					} else {
+						refs[n][k] = v
+					}
+				}
+			}
+		}
+		bucketCheck(t, db, refs)
+		// a reader keeps a deleted bucket
+		reader, err := db.BeginRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteBucket([]byte("events")); err != nil {
+			t.Fatal(err)
+		}
+		rb, err := reader.Bucket([]byte("events"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if it := rb.Scan(nil, nil); !it.Valid() && len(refs["events"]) > 0 {
+			t.Fatal("deleted bucket in the snapshot")
+		}
+		reader.EndRead()
+		delete(refs, "events")
+		bucketCheck(t, db, refs)
+		// deleted and created again in a transaction, with a handle across
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := tx.Bucket([]byte("sessions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.DeleteBucket([]byte("sessions")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Set([]byte("x"), []byte("y")); !errors.Is(err, ErrBucketNotFound) {
+			t.Fatal("deleted bucket", err)
+		}
+		if err := tx.CreateBucket([]byte("sessions")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Set([]byte("x"), []byte("y")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		refs["sessions"] = map[string]string{"x": "y"}
+		bucketCheck(t, db, refs)
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		bucketCheck(t, db, refs)
+		var buf bytes.Buffer
+		if err := db.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path+".backup", buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{path, path + ".backup"} {
+			db = &KV{Path: p, Options: opt}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			bucketCheck(t, db, refs)
+			if v, _, _ := db.Get([]byte("main")); string(v) != "m" {
+				t.Fatal("main tree", p)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// a file of the format before buckets, with a log, is converted by the first writer
+func TestBucketsV09(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("k%d", i)
+		ref[k] = strings.Repeat("v", i*7)
+		if err := db.Set([]byte(k), []byte(ref[k])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slot := masterCurrent(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	masterRewrite(t, path, DB_SIG_V09, slot)
+	// a log record without pages
+	rec := make([]byte, WAL_HEADER_V09)
+	binary.LittleEndian.PutUint64(rec[0:], slot.txid+1)
+	binary.LittleEndian.PutUint64(rec[8:], slot.root)
+	binary.LittleEndian.PutUint64(rec[16:], slot.used)
+	binary.LittleEndian.PutUint64(rec[24:], slot.free.headPage)
+	binary.LittleEndian.PutUint64(rec[32:], slot.free.headSeq)
+	binary.LittleEndian.PutUint64(rec[40:], slot.free.tailPage)
+	binary.LittleEndian.PutUint64(rec[48:], slot.free.tailSeq)
+	rec = binary.LittleEndian.AppendUint32(rec, crc32.Checksum(rec, crcTable))
+	if err := os.WriteFile(path+".wal", rec, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader replays the log and leaves the files as they are
+	ro := &KV{Path: path, Options: Options{ReadOnly: true}}
+	if err := ro.Open(); err != nil {
+		t.Fatal(err)
+	}
+	kvCheck(t, ro, ref)
+	if ro.txid != slot.txid+1 {
+		t.Fatal("the log is not replayed", ro.txid)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &KV{Path: path, Options: Options{WAL: true}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	kvCheck(t, db, ref)
+	if err := db.CreateBucket([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("after"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	ref["after"] = "x"
+	cpath := path + ".crash"
+	copyFile(t, path+".wal", cpath+".wal")
+	copyFile(t, path, cpath)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, cpath} {
+		db = &KV{Path: p}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		kvCheck(t, db, ref)
+		if _, err := db.Bucket([]byte("b")); err != nil {
+			t.Fatal(p, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
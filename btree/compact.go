@@ -0,0 +1,182 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// the number of updated pages to hold in memory before committing a copy
+const COPY_BATCH_PAGES = 256
+
+// a replaced file, kept until the readers that started before are done
+type kvRetired struct {
+	version uint64    // the first version that doesn't use the file
+	store   PageStore // the replaced file
+}
+
+// rewrite the database into a new file without the free pages and swap it in,
+// so that the file shrinks after deleting a lot of data.
+// the writer lock is held for the whole copy, so commits wait for as long as it takes
+// to copy the database. readers don't: the ones that are already running
+// keep reading the old file, and new ones see the same data in the new file.
+func (db *KV) Compact() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.store == nil {
+		return ErrClosed
+	}
+	if db.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	// the commits still syncing and the log belong to the old file
+	if err := kvSyncAll(db); err != nil {
+		return fmt.Errorf("Compact: %w", err)
+	}
+	if db.wal.fp != nil {
+		if err := walCheckpoint(db); err != nil {
+			return fmt.Errorf("Compact: %w", err)
+		}
+	}
+	// copy the committed tree to a new file next to it, with a name of its own
+	fp, err := os.CreateTemp(filepath.Dir(db.Path), filepath.Base(db.Path)+".tmp.*")
+	if err != nil {
+		return fmt.Errorf("Compact: %w", err)
+	}
+	tmp := fp.Name()
+	fp.Close()
+	// the same kind of storage and pages, the default SyncMode
+	dst := &KV{Path: tmp, Options: Options{
+		Store:     db.Options.Store,
+		CacheSize: db.Options.CacheSize,
+		Compress:  db.Options.Compress,
+		Key:       db.Options.Key,
+	}}
+	if err := dst.Open(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Compact: %w", err)
+	}
+	err = treeCopy(&db.tree, dst, OVERFLOW_CAP, nil)
+	if err == nil {
+		err = catalogCopy(&db.catalog, dst)
+	}
+	if _, ok := dst.store.(*MemStore); err == nil && ok {
+		os.Remove(tmp) // the in-memory store has no file to replace
+	} else if err == nil {
+		err = os.Rename(tmp, db.Path)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("Compact: %w", err)
+	}
+
+	// take over the new file, the old one is gone once it's closed
+	old := db.store
+	db.store = dst.store
+	db.txid = dst.txid
+	db.slot = dst.slot
+	db.crypt.kcv = dst.crypt.kcv
+	lockRelease(db) // the new file is locked by now
+	db.lock, dst.lock = dst.lock, nil
+	db.tree.root = dst.tree.root
+	db.catalog.root = dst.catalog.root
+	db.page.flushed = dst.page.flushed
+	db.free.flData = dst.free.flData
+	// nobody reads the new file yet, all its free pages can be reused
+	db.free.maxSeq = db.free.tailSeq
+	db.free.commits = nil
+	version := kvPublish(db)
+	kvSynced(db, version) // the copy is durable
+	db.mu.Lock()
+	db.retired = append(db.retired, kvRetired{version: version, store: old})
+	kvRelease(db)
+	db.mu.Unlock()
+	return nil
+}
+
+// close the retired files that no reader uses anymore. called with db.mu held.
+func kvRelease(db *KV) {
+	for len(db.retired) > 0 {
+		for version := range db.readers {
+			if version < db.retired[0].version {
+				return // still in use
+			}
+		}
+		db.retired[0].store.Close() // nothing to do about a failure, the file is gone anyway
+		db.retired = db.retired[1:]
+	}
+}
+
+// copy every KV of the source tree into the destination database,
+// or into a bucket of it that exists.
+// the values are read from overflow pages of `ovCap` bytes.
+// the copy is committed in batches to bound the memory use.
+func treeCopy(src *BTree, dst *KV, ovCap uint64, bucket []byte) error {
+	tx, err := dst.Begin()
+	if err != nil {
+		return err
+	}
+	set := txSetter(tx, bucket)
+	iter := src.SeekGE(nil)
+	for ; iter.Valid(); iter.Next() {
+		last := len(iter.path) - 1
+		node, idx := iter.path[last], iter.pos[last]
+		val := node.getVal(idx)
+		if node.isValRef(idx) {
+			if val, err = overflowReadCap(src, val, ovCap); err != nil {
+				tx.Abort()
+				return err
+			}
+		}
+		if err := set(iter.key(), val); err != nil {
+			tx.Abort()
+			return err
+		}
+		if len(dst.page.updates) < COPY_BATCH_PAGES {
+			continue
+		}
+		// the updates are kept in memory until the commit
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if tx, err = dst.Begin(); err != nil {
+			return err
+		}
+		set = txSetter(tx, bucket)
+	}
+	if err := iter.Err(); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// the Set of the main tree or of a bucket in the tx
+func txSetter(tx *KVTX, bucket []byte) func(key []byte, val []byte) error {
+	if bucket == nil {
+		return tx.Set
+	}
+	b := &BucketTX{tx: tx, name: bucket}
+	return b.Set
+}
+
+// copy the buckets of the source catalog into the destination database
+func catalogCopy(catalog *BTree, dst *KV) error {
+	iter := catalog.SeekGE(nil)
+	for ; iter.Valid(); iter.Next() {
+		name, val := iter.Deref()
+		if len(val) != CATALOG_VAL_SIZE {
+			return fmt.Errorf("%w: bad catalog entry %q", ErrCorruptPage, name)
+		}
+		if err := dst.CreateBucket(name); err != nil {
+			return err
+		}
+		src := bucketTree(catalog, binary.LittleEndian.Uint64(val))
+		if err := treeCopy(src, dst, OVERFLOW_CAP, name); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
@@ -0,0 +1,113 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		n := 100
+		if i%500 == 0 {
+			n = 50000
+		}
+		if err := tx.Set([]byte(fmt.Sprintf("k%06d", i)), bytes.Repeat([]byte{byte(i)}, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		if i%10 != 0 {
+			if _, err := tx.Del([]byte(fmt.Sprintf("k%06d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fi.Size()
+
+	// readers keep going during the compaction
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for g := 0; g < 3; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				v, ok, err := db.Get([]byte("k000500"))
+				if err != nil || !ok || len(v) != 50000 {
+					t.Error("get", ok, err)
+					return
+				}
+			}
+		}()
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stop.Store(true)
+	wg.Wait()
+	if fi, err = os.Stat(path); err != nil || fi.Size() >= before/2 {
+		t.Fatal("not smaller", before, fi.Size(), err)
+	}
+	// the old reader still sees the old file until it ends
+	if _, ok, err := old.Get([]byte("k000001")); err != nil || !ok {
+		t.Fatal("old reader", ok, err)
+	}
+	old.EndRead()
+	if len(db.retired) != 0 {
+		t.Fatal("the old file is not released")
+	}
+	res, err := db.Verify()
+	if err != nil || !res.OK() || res.Keys != 2000 {
+		t.Fatal(err, res.Errors, res.Keys)
+	}
+	if err := db.Set([]byte("new"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	res, err = db.Verify()
+	if err != nil || !res.OK() || res.Keys != 2001 {
+		t.Fatal(err, res.Errors, res.Keys)
+	}
+	if tmp, _ := filepath.Glob(path + ".tmp.*"); len(tmp) != 0 {
+		t.Fatal("leftover files", tmp)
+	}
+}
@@ -0,0 +1,85 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// the compression of the pages written by a KV, see Options.Compress
+type Codec uint16
+
+const (
+	CodecNone  Codec = iota // pages are written as they are
+	CodecFlate              // compress/flate at the best speed
+)
+
+// a compressed page replaces the node with the compressed bytes of the whole node.
+// every page records its own codec, so the option only affects new pages.
+// the page keeps its slot in the file and its trailer,
+// the rest of the node area is zeroed, see walWrite for where it's left out.
+//
+// the compressed page format.
+// | type | codec | size | compressed node |
+// |  2B  |  2B   |  2B  |   size bytes    |
+const BNODE_COMPRESSED = 5
+const COMPRESSED_HEADER = 6
+
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+var flateReaders = sync.Pool{New: func() any {
+	return flate.NewReader(bytes.NewReader(nil))
+}}
+
+// compress a node into the node area of `page`.
+// returns false if the codec doesn't make it smaller.
+func pageCompress(codec Codec, page []byte, node []byte) bool {
+	if codec != CodecFlate {
+		return false
+	}
+	// the free list tail is updated in place, its bytes must stay where they are
+	btype := BNode{node}.btype()
+	if btype != BNODE_LEAF && btype != BNODE_NODE && btype != BNODE_OVERFLOW {
+		return false
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	w.Write(node[:BTREE_NODE_SIZE]) // can't fail on a bytes.Buffer
+	w.Close()
+	if COMPRESSED_HEADER+buf.Len() >= BTREE_NODE_SIZE {
+		return false
+	}
+	binary.LittleEndian.PutUint16(page[0:], BNODE_COMPRESSED)
+	binary.LittleEndian.PutUint16(page[2:], uint16(codec))
+	binary.LittleEndian.PutUint16(page[4:], uint16(buf.Len()))
+	copy(page[COMPRESSED_HEADER:], buf.Bytes())
+	return true
+}
+
+// the node of a verified page, decompressed if needed
+func pageDecode(page []byte, ptr uint64) (BNode, error) {
+	if binary.LittleEndian.Uint16(page[0:]) != BNODE_COMPRESSED {
+		return BNode{page}, nil
+	}
+	codec := Codec(binary.LittleEndian.Uint16(page[2:]))
+	size := int(binary.LittleEndian.Uint16(page[4:]))
+	if codec != CodecFlate || COMPRESSED_HEADER+size > BTREE_NODE_SIZE {
+		return BNode{}, fmt.Errorf("%w: bad compressed page %d", ErrCorruptPage, ptr)
+	}
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(page[COMPRESSED_HEADER:][:size]), nil)
+	node := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := io.ReadFull(r, node[:BTREE_NODE_SIZE]); err != nil {
+		return BNode{}, fmt.Errorf("%w: bad compressed page %d: %v", ErrCorruptPage, ptr, err)
+	}
+	return BNode{node}, nil
+}
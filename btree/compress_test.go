@@ -0,0 +1,78 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compressed pages are read back from the file and the log
+func TestCompress(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		for _, codec := range []Codec{CodecNone, CodecFlate} {
+			path := filepath.Join(t.TempDir(), "db")
+			db := &KV{Path: path, Options: Options{WAL: wal, Compress: codec}}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			ref := map[string]string{}
+			r := rand.New(rand.NewSource(9))
+			for i := 0; i < 2000; i++ {
+				k := fmt.Sprintf("k%05d", r.Intn(800))
+				v := strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"x"},`, i), r.Intn(300))
+				if r.Intn(4) == 0 {
+					delete(ref, k)
+					if _, err := db.Del([]byte(k)); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					ref[k] = v
+					if err := db.Set([]byte(k), []byte(v)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			kvCheck(t, db, ref)
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			res, err := db.Verify()
+			if err != nil || !res.OK() {
+				t.Fatal(wal, codec, err, res.Errors)
+			}
+			cpath := path + ".crash"
+			if wal {
+				v := strings.Repeat("a", 2000)
+				if err := db.Set([]byte("after"), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+				ref["after"] = v
+				copyFile(t, path+".wal", cpath+".wal")
+			}
+			copyFile(t, path, cpath)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{path, cpath} {
+				db = &KV{Path: p}
+				if err := db.Open(); err != nil {
+					t.Fatal(wal, codec, err)
+				}
+				kvCheck(t, db, ref)
+				page, err := db.store.Read(db.tree.root)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compressed := binary.LittleEndian.Uint16(page) == BNODE_COMPRESSED; compressed != (codec == CodecFlate) {
+					t.Fatal("bad page type", wal, codec, compressed)
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
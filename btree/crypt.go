@@ -0,0 +1,268 @@
+package btree
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// with Options.Key every page but the master page is encrypted with AES-GCM.
+// a page is sealed as a whole, trailer included, with a random nonce
+// and the page number as additional data, so pages can't be swapped.
+// the file slot of a page grows by the nonce and the tag.
+// | nonce | encrypted page | tag |
+// |  12B  |      4KB       | 16B |
+const CRYPT_NONCE_SIZE = 12
+const CRYPT_SLOT_SIZE = CRYPT_NONCE_SIZE + BTREE_PAGE_SIZE + 16
+
+// the master page stays in plain text, its slots must be updated independently.
+// it holds the key-check value in a disk sector of its own, written with the first commit.
+// | magic | nonce scheme | nonce | 16 zero bytes encrypted | tag |
+// |  6B   |      2B      |  12B  |           16B           | 16B |
+const MASTER_KCV_OFFSET = BTREE_PAGE_SIZE / 4
+const MASTER_KCV_SIZE = 6 + 2 + CRYPT_NONCE_SIZE + 16 + 16
+const KCV_MAGIC = "AESGCM"
+
+// the only nonce scheme: random for each write, stored in front of the page
+const CRYPT_NONCE_RANDOM = 1
+
+// the AES-GCM cipher of a key of 16, 24 or 32 bytes
+func cryptCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt `data` with a new nonce, the result is the nonce followed by the sealed data
+func cryptSeal(aead cipher.AEAD, ptr uint64, data []byte) ([]byte, error) {
+	out := make([]byte, CRYPT_NONCE_SIZE, CRYPT_NONCE_SIZE+len(data)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	return aead.Seal(out, out, data, ad[:]), nil
+}
+
+// decrypt the result of cryptSeal
+func cryptOpen(aead cipher.AEAD, ptr uint64, data []byte) ([]byte, error) {
+	if len(data) < CRYPT_NONCE_SIZE+aead.Overhead() {
+		return nil, fmt.Errorf("%w: bad encrypted page %d", ErrCorruptPage, ptr)
+	}
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	out, err := aead.Open(nil, data[:CRYPT_NONCE_SIZE], data[CRYPT_NONCE_SIZE:], ad[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: page %d fails authentication", ErrCorruptPage, ptr)
+	}
+	return out, nil
+}
+
+// a new key-check value
+func kcvEncode(aead cipher.AEAD) ([]byte, error) {
+	sealed, err := cryptSeal(aead, 0, make([]byte, 16))
+	if err != nil {
+		return nil, err
+	}
+	kcv := make([]byte, 0, MASTER_KCV_SIZE)
+	kcv = append(kcv, KCV_MAGIC...)
+	kcv = binary.LittleEndian.AppendUint16(kcv, CRYPT_NONCE_RANDOM)
+	return append(kcv, sealed...), nil
+}
+
+// check the key against a key-check value
+func kcvVerify(aead cipher.AEAD, kcv []byte) error {
+	if binary.LittleEndian.Uint16(kcv[6:]) != CRYPT_NONCE_RANDOM {
+		return fmt.Errorf("%w: unknown nonce scheme", ErrCorruptPage)
+	}
+	data, err := cryptOpen(aead, 0, kcv[8:MASTER_KCV_SIZE])
+	if err != nil || !bytes.Equal(data, make([]byte, 16)) {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// check Options.Key against the file before it's opened.
+// the master page is at the start of the file with or without encryption.
+func cryptInit(db *KV) error {
+	if db.Options.Store != nil {
+		if db.Options.Key != nil {
+			return errors.New("Options.Key doesn't work with Options.Store")
+		}
+		return nil
+	}
+	var kcv []byte
+	page, err := cryptPeek(db.Path)
+	if err != nil {
+		return err
+	}
+	if page != nil && bytes.Equal(page[MASTER_KCV_OFFSET:][:len(KCV_MAGIC)], []byte(KCV_MAGIC)) {
+		kcv = page[MASTER_KCV_OFFSET:][:MASTER_KCV_SIZE]
+	}
+	if db.Options.Key == nil {
+		if kcv != nil {
+			return fmt.Errorf("%w: the file is encrypted", ErrWrongKey)
+		}
+		return nil
+	}
+	aead, err := cryptCipher(db.Options.Key)
+	if err != nil {
+		return err
+	}
+	if kcv == nil && page != nil {
+		return fmt.Errorf("%w: the file is not encrypted", ErrWrongKey)
+	}
+	if kcv == nil {
+		// a new file
+		if kcv, err = kcvEncode(aead); err != nil {
+			return err
+		}
+	} else if err := kcvVerify(aead, kcv); err != nil {
+		return err
+	}
+	db.crypt.aead = aead
+	db.crypt.kcv = kcv
+	return nil
+}
+
+// the free list tail is the only page that the committed state refers to
+// and that a commit updates in place, see FreeList.PushTail.
+// in WAL mode the log still has the pages that a checkpoint was writing.
+// otherwise a tail that can't be decrypted is replaced by a new free list,
+// whose items are the pages that the trees don't reach.
+func cryptRecover(db *KV) error {
+	if db.crypt.aead == nil || db.Options.WAL || db.Options.ReadOnly || db.free.tailPage == 0 {
+		return nil
+	}
+	if _, err := db.store.Read(db.free.tailPage); !errors.Is(err, ErrCorruptPage) {
+		return err
+	}
+	return freeRebuild(db)
+}
+
+// the master page of a file, nil if the file is missing or too short
+func cryptPeek(path string) ([]byte, error) {
+	fp, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer fp.Close()
+	page := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := io.ReadFull(fp, page); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil // the store checks the size
+	} else if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return page, nil
+}
+
+// the slot of a page in an encrypted file
+func cryptEncode(aead cipher.AEAD, ptr uint64, page []byte) ([]byte, error) {
+	if ptr == 0 {
+		slot := make([]byte, CRYPT_SLOT_SIZE)
+		copy(slot, page[:BTREE_PAGE_SIZE])
+		return slot, nil
+	}
+	return cryptSeal(aead, ptr, page[:BTREE_PAGE_SIZE])
+}
+
+// a file of encrypted pages, read and written with pread and pwrite.
+// unlike the other stores, a page that is torn by a crash can't be read at all,
+// see cryptRecover.
+type CryptStore struct {
+	fp       *os.File
+	aead     cipher.AEAD
+	readOnly bool          // Write and Grow fail
+	file     atomic.Uint64 // file size in pages
+}
+
+// open or create an encrypted file. the key isn't checked, see Options.Key.
+func OpenCryptStore(path string, key []byte, readOnly bool) (*CryptStore, error) {
+	aead, err := cryptCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	fp, npages, err := openPageFile(path, CRYPT_SLOT_SIZE, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	store := &CryptStore{fp: fp, aead: aead, readOnly: readOnly}
+	store.file.Store(npages)
+	return store, nil
+}
+
+func (store *CryptStore) Read(ptr uint64) ([]byte, error) {
+	if ptr >= store.file.Load() {
+		return nil, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	slot := make([]byte, CRYPT_SLOT_SIZE)
+	if _, err := store.fp.ReadAt(slot, int64(ptr*CRYPT_SLOT_SIZE)); err != nil {
+		return nil, fmt.Errorf("read page %d: %w", ptr, err)
+	}
+	if ptr == 0 {
+		return slot[:BTREE_PAGE_SIZE], nil
+	}
+	// a page that was never written reads as zeros, like in the other stores.
+	// it fails the checksum of pageRead.
+	if bytes.Count(slot, []byte{0}) == len(slot) {
+		return slot[:BTREE_PAGE_SIZE], nil
+	}
+	return cryptOpen(store.aead, ptr, slot)
+}
+
+func (store *CryptStore) Write(ptr uint64, page []byte) error {
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if ptr >= store.file.Load() {
+		return fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	slot, err := cryptEncode(store.aead, ptr, page)
+	if err != nil {
+		return fmt.Errorf("write page %d: %w", ptr, err)
+	}
+	if _, err := store.fp.WriteAt(slot, int64(ptr*CRYPT_SLOT_SIZE)); err != nil {
+		return fmt.Errorf("write page %d: %w", ptr, err)
+	}
+	return nil
+}
+
+func (store *CryptStore) Sync() error {
+	return store.fp.Sync()
+}
+
+func (store *CryptStore) Size() uint64 {
+	return store.file.Load()
+}
+
+func (store *CryptStore) Grow(npages uint64) error {
+	if store.file.Load() >= npages {
+		return nil
+	}
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	filePages := growPages(store.file.Load(), npages)
+	if err := fallocatePages(store.fp, filePages, CRYPT_SLOT_SIZE); err != nil {
+		return err
+	}
+	store.file.Store(filePages)
+	return nil
+}
+
+func (store *CryptStore) Close() error {
+	store.file.Store(0)
+	return store.fp.Close()
+}
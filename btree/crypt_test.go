@@ -0,0 +1,286 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func cryptTestSet(t *testing.T, db *KV, lo int, hi int, val string) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := lo; i < hi; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if val == "" {
+			_, err = tx.Del(key)
+		} else {
+			err = tx.Set(key, []byte(val))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cryptTestVerify(t *testing.T, db *KV) {
+	res, err := db.Verify()
+	if err != nil || !res.OK() {
+		t.Fatal(err, res.Errors)
+	}
+}
+
+// no plaintext in the file, the log or a backup
+func TestCrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, opts := range []Options{{WAL: true}, {CacheSize: 1 << 16, WAL: true}, {Compress: CodecFlate, CacheSize: 1 << 16}, {}} {
+		opts.Key = key
+		path := filepath.Join(t.TempDir(), "db")
+		db := &KV{Path: path, Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		ref := map[string]string{}
+		r := rand.New(rand.NewSource(3))
+		for i := 0; i < 1500; i++ {
+			k := fmt.Sprintf("secret%05d", r.Intn(600))
+			v := string(bytes.Repeat([]byte("plaintext"), r.Intn(700)))
+			if r.Intn(4) == 0 {
+				delete(ref, k)
+				if _, err := db.Del([]byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				ref[k] = v
+				if err := db.Set([]byte(k), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		kvCheck(t, db, ref)
+		cryptTestVerify(t, db)
+		var buf bytes.Buffer
+		if err := db.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+		bpath := path + ".backup"
+		if err := os.WriteFile(bpath, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{path, path + ".wal", bpath} {
+			data, err := os.ReadFile(p)
+			if os.IsNotExist(err) && !opts.WAL {
+				continue // no log
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("plaintext")) || bytes.Contains(data, []byte("secret")) {
+				t.Fatal("plaintext in", p)
+			}
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set([]byte("after"), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		ref["after"] = "x"
+		cryptTestVerify(t, db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, bad := range [][]byte{nil, bytes.Repeat([]byte{8}, 32)} {
+			db = &KV{Path: path, Options: Options{Key: bad, WAL: true}}
+			if err := db.Open(); !errors.Is(err, ErrWrongKey) {
+				db.Close()
+				t.Fatal("wrong key", err)
+			}
+		}
+		db = &KV{Path: path, Options: Options{Key: []byte("short"), WAL: true}}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatal("short key")
+		}
+		db = &KV{Path: path, Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		kvCheck(t, db, ref)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		delete(ref, "after")
+		db = &KV{Path: bpath, Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		kvCheck(t, db, ref)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a plain file opened with a key
+	path := filepath.Join(t.TempDir(), "plain")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &KV{Path: path, Options: Options{Key: key, WAL: true}}
+	if err := db.Open(); !errors.Is(err, ErrWrongKey) {
+		db.Close()
+		t.Fatal("plain file", err)
+	}
+}
+
+// a checkpoint torn in the free list tail is written again from the log
+func TestCryptTornTail(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	opts := Options{Key: key, WAL: true}
+	db := &KV{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	val := string(bytes.Repeat([]byte("v"), 1000))
+	cryptTestSet(t, db, 0, 300, val)
+	cryptTestSet(t, db, 0, 100, "")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// freed pages are pushed to the tail in the log only
+	db = &KV{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tail := db.free.tailPage
+	cryptTestSet(t, db, 100, 120, "")
+	if db.free.tailPage != tail {
+		t.Fatal("the tail node is full")
+	}
+	// a crash while the checkpoint writes the tail
+	crash := filepath.Join(dir, "crash")
+	for _, suffix := range []string{"", ".wal"} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suffix == "" {
+			if tail >= uint64(len(data)/CRYPT_SLOT_SIZE) {
+				t.Fatal("the tail is not in the file")
+			}
+			slot := data[tail*CRYPT_SLOT_SIZE:][:CRYPT_SLOT_SIZE]
+			copy(slot[CRYPT_SLOT_SIZE/2:], bytes.Repeat([]byte{0xa5}, CRYPT_SLOT_SIZE/2))
+		}
+		if err := os.WriteFile(crash+suffix, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &KV{Path: crash, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cryptTestVerify(t, db)
+	cryptTestSet(t, db, 120, 200, "")
+	cryptTestSet(t, db, 300, 400, val)
+	cryptTestVerify(t, db)
+	for i := 0; i < 400; i++ {
+		v, ok, err := db.Get([]byte(fmt.Sprintf("k%04d", i)))
+		if err != nil || ok != (i >= 200) || (ok && string(v) != val) {
+			t.Fatal("get", i, ok, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// without the WAL, a free list tail torn by a crash is replaced at Open
+func TestCryptNoWAL(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	opts := Options{Key: key}
+	db := &KV{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	val := string(bytes.Repeat([]byte("v"), 1000))
+	cryptTestSet(t, db, 0, 300, val)
+	cryptTestSet(t, db, 0, 100, "")
+	tail := db.free.tailPage
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash while a commit writes the tail
+	crash := filepath.Join(dir, "crash")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := data[tail*CRYPT_SLOT_SIZE:][:CRYPT_SLOT_SIZE]
+	copy(slot[CRYPT_SLOT_SIZE/2:], bytes.Repeat([]byte{0xa5}, CRYPT_SLOT_SIZE/2))
+	if err := os.WriteFile(crash, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the reader can't replace it, but it can read the trees
+	db = &KV{Path: crash, Options: Options{Key: key, ReadOnly: true}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := db.Get([]byte("k0100")); err != nil || !ok || string(v) != val {
+		t.Fatal("get", ok, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &KV{Path: crash, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if db.free.tailPage == tail || db.free.Total() == 0 {
+		t.Fatal("the free list is not rebuilt", db.free.tailPage, db.free.Total())
+	}
+	cryptTestVerify(t, db)
+	cryptTestSet(t, db, 100, 200, "")
+	cryptTestSet(t, db, 300, 400, val)
+	cryptTestVerify(t, db)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &KV{Path: crash, Options: opts}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cryptTestVerify(t, db)
+	for i := 0; i < 400; i++ {
+		v, ok, err := db.Get([]byte(fmt.Sprintf("k%04d", i)))
+		if err != nil || ok != (i >= 200) || (ok && string(v) != val) {
+			t.Fatal("get", i, ok, err)
+		}
+	}
+}
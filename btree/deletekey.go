@@ -2,6 +2,7 @@ package btree
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/abedmohammed/goDB/utils"
 )
@@ -14,51 +15,80 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 }
 
 // recursive function to delete a key from the tree
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, error) {
 	// find index of key to pull key from node
 	idx := nodeLookupLE(node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF: // if leaf
 		if !bytes.Equal(key, node.getKey(idx)) {
-			return BNode{} // key not found
+			return BNode{}, nil // key not found
+		}
+		// free the overflow pages of the value
+		if node.isValRef(idx) {
+			if err := overflowFree(tree, node.getVal(idx)); err != nil {
+				return BNode{}, err
+			}
 		}
 		// delete the key in the leaf
 		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)} // allocate empty node
 		leafDelete(new, node, idx)
-		return new
+		return new, nil
 	case BNODE_NODE: // if internal
 		return nodeDelete(tree, node, idx, key)
 	default:
-		panic("treeDelete: bad node!")
+		return BNode{}, fmt.Errorf("%w: bad node type %d", ErrCorruptPage, node.btype())
 	}
 }
 
 // merging nodes into left or right siblings during deletion of internal nodes
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error) {
 	// recurse to delete kid
 	kidPtr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.get(kidPtr), key)
-	if len(updated.data) == 0 {
-		return BNode{}
+	kid, err := tree.get(kidPtr)
+	if err != nil {
+		return BNode{}, err
+	}
+	updated, err := treeDelete(tree, kid, key)
+	if err != nil || len(updated.data) == 0 {
+		return BNode{}, err
+	}
+	if err := tree.del(kidPtr); err != nil {
+		return BNode{}, err
 	}
-	tree.del(kidPtr)
 
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	// the result node.
+	// updated kid keys may be longer, so it's allowed to be bigger than 1 page
+	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
 
 	// get merge direction - either left or right sibling
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	mergeDir, sibling, err := shouldMerge(tree, node, idx, updated)
+	if err != nil {
+		return BNode{}, err
+	}
 	switch {
 	case mergeDir < 0: // if left
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)} // prepare new node to merge old into
 		nodeMerge(merged, sibling, updated)
-		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		if err := tree.del(node.getPtr(idx - 1)); err != nil {
+			return BNode{}, err
+		}
+		ptr, err := tree.new(merged)
+		if err != nil {
+			return BNode{}, err
+		}
+		nodeReplace2Kid(new, node, idx-1, ptr, merged.getKey(0))
 	case mergeDir > 0: // if right
 		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)} // prepare new node to merge old into
 		nodeMerge(merged, updated, sibling)
-		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+		if err := tree.del(node.getPtr(idx + 1)); err != nil {
+			return BNode{}, err
+		}
+		ptr, err := tree.new(merged)
+		if err != nil {
+			return BNode{}, err
+		}
+		nodeReplace2Kid(new, node, idx, ptr, merged.getKey(0))
 	case mergeDir == 0:
 		if updated.nkeys() == 0 { // parent only has one child, child is empty after deletion
 			// no siblings to merge with therefore discard empty kid and return empty parent
@@ -66,10 +96,14 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 			new.setHeader(BNODE_NODE, 0)
 			// empty node will be eliminated before reaching the root
 		} else {
-			nodeReplaceKidN(tree, new, node, idx, updated)
+			// the kid might have outgrown a page because of a longer key
+			nsplit, splitted := nodeSplit3(updated)
+			if err := nodeReplaceKidN(tree, new, node, idx, splitted[:nsplit]...); err != nil {
+				return BNode{}, err
+			}
 		}
 	}
-	return new
+	return new, nil
 }
 
 // merge 2 nodes
@@ -83,48 +117,64 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 // conditions for merging:
 // node is smaller than 1/4 of a page
 // node has a sibling and the merged results
-func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
-		return 0, BNode{}
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode, error) {
+	if updated.nbytes() > BTREE_NODE_SIZE/4 {
+		return 0, BNode{}, nil
 	}
 
 	if idx > 0 {
-		sibling := tree.get(node.getPtr(idx - 1))
+		sibling, err := tree.get(node.getPtr(idx - 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return -1, sibling
+		if merged <= BTREE_NODE_SIZE {
+			return -1, sibling, nil
 		}
 	}
 
 	if idx+1 < node.nkeys() {
-		sibling := tree.get(node.getPtr(idx + 1))
+		sibling, err := tree.get(node.getPtr(idx + 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return +1, sibling
+		if merged <= BTREE_NODE_SIZE {
+			return +1, sibling, nil
 		}
 	}
 
-	return 0, BNode{}
+	return 0, BNode{}, nil
 }
 
 // deletion interface
 // hieght reduced by one if the root is not a leaf, or the root has only one child
-func (tree *BTree) Delete(key []byte) bool {
-	utils.Assert(len(key) == 0, "Delete: Empty key!")
-	utils.Assert(len(key) > BTREE_MAX_KEY_SIZE, "Delete: Key length greater than maximum size!")
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
 
-	updated := treeDelete(tree, tree.get(tree.root), key)
-	if len(updated.data) == 0 {
-		return false // not found
+	if tree.root == 0 {
+		return false, nil // empty tree
+	}
+	root, err := tree.get(tree.root)
+	if err != nil {
+		return false, err
+	}
+	updated, err := treeDelete(tree, root, key)
+	if err != nil || len(updated.data) == 0 {
+		return false, err // not found
 	}
 
-	tree.del(tree.root)
+	if err := tree.del(tree.root); err != nil {
+		return false, err
+	}
 	// if 1 key in internal node
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		// remove level
 		tree.root = updated.getPtr(0) // assign root to 0 pointer
-	} else {
-		tree.root = tree.new(updated) // assign root to point to updated node
+	} else if err := treeSetRoot(tree, updated); err != nil { // assign root to point to updated node
+		return false, err
 	}
-	return true
+	return true, nil
 }
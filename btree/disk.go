@@ -2,227 +2,464 @@ package btree
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
-	"syscall"
+	"sync"
 
 	"github.com/abedmohammed/goDB/utils"
 )
 
-// create the initial mmap that covers the whole file.
-func mmapInit(fp *os.File) (int, []byte, error) {
-	fi, err := fp.Stat()
-	if err != nil {
-		return 0, nil, fmt.Errorf("stat: %w", err)
-	}
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
-		return 0, nil, errors.New("File size is not a multiple of page size.")
-	}
-	mmapSize := 64 << 20
-	utils.Assert(mmapSize%BTREE_PAGE_SIZE == 0, "ERROR!")
-	for mmapSize < int(fi.Size()) {
-		mmapSize *= 2
-	}
-	// mmapSize can be larger than the file
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return 0, nil, fmt.Errorf("mmap: %w", err)
-	}
-	return int(fi.Size()), chunk, nil
+// the options of a KV, set before Open
+type Options struct {
+	WAL  bool     // commit to a write-ahead log instead of the main file, see wal.go
+	Sync SyncMode // how commits are made durable
+	// opens the pages of the file at a path, OpenMmapStore by default.
+	// KV.Compact uses it for the new file too.
+	Store func(path string) (PageStore, error)
+	// read the file with pread through a BufferPool of this many bytes
+	// instead of mmap, when Store is not set
+	CacheSize int
+	// compress the pages written from now on, any codec can be read
+	Compress Codec
+	// an AES key of 16, 24 or 32 bytes to encrypt the file and the log with,
+	// see crypt.go. a file is encrypted from its creation on or never.
+	// a torn page can't be decrypted. without the WAL, a free list tail
+	// that is torn by a crash is found by Open, which rebuilds the free list.
+	Key []byte
+	// open an existing file for reading only, with a shared lock.
+	// other read-only processes can open it too, but not a writer:
+	// it would reuse pages that the readers still see. KV.Backup makes a copy to read.
+	ReadOnly bool
 }
 
+// the durability of commits, at the cost of fsyncs
+type SyncMode int
+
+const (
+	// Commit returns once the commit is durable.
+	// it takes 2 fsyncs, one in WAL mode. concurrent commits share them.
+	SyncFull SyncMode = iota
+	// a crash can lose the last commits, but doesn't damage the database.
+	// it takes 1 fsync per commit, none in WAL mode until a checkpoint.
+	SyncNormal
+	// no fsyncs, the OS writes the data when it wants.
+	// a crash of the process is fine, a crash of the system can damage the database.
+	// with Options.CacheSize the master page is written through the BufferPool
+	// after the pages of its commit, so the process can crash with dirty pages in it.
+	SyncOff
+)
+
 type KV struct {
-	Path string
+	Path    string
+	Options Options
 	// internals
-	fp   *os.File
-	tree BTree
-	mmap struct {
-		file   int      // file size, can be larger than the database size
-		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
-	}
-	page struct {
+	lock    *os.File // holds the flock of the file, see lockFile
+	store   PageStore
+	tree    BTree
+	catalog BTree // the roots of the buckets, see bucket.go
+	free    FreeList
+	txid    uint64 // id of the last commit
+	slot    int    // the master page slot written last, see masterStore
+	page    struct {
 		flushed uint64 // database size in number of pages
-		nfree   int    // number of pages taken from the free list
 		nappend int    // number of pages to be appended
 		// newly allocated or deallocated pages keyed by the pointer.
 		// nil value denotes a deallocated page.
 		updates map[uint64][]byte
 	}
-}
-
-func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
-		return nil
+	// the fields above belong to the write transaction,
+	// readers only see the last committed version below.
+	writer sync.Mutex // held by the write transaction
+	mu     sync.Mutex // protects the fields below
+	commit struct {
+		version uint64            // incremented on each commit
+		master  masterSlot        // the master page of the version
+		store   PageStore         // the file of the version
+		wal     map[uint64][]byte // the log index that covers the version
 	}
-	// double the address space
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+	readers map[uint64]int // number of readers of each version
+	retired []kvRetired    // see KV.Compact
+	// group commit, see sync.go
+	sync struct {
+		mu      sync.Mutex
+		cond    sync.Cond  // signaled when an fsync is done
+		written uint64     // the last version that was written
+		master  masterSlot // the master page of the written version
+		synced  uint64     // the last version that is as durable as the SyncMode says
+		durable uint64     // the last version whose master page is durable
+		saved   uint64     // the version of the master page written last
+		running bool       // an fsync is in progress
+		err     error      // a failed fsync, commits are refused after that
+	}
+	// the write-ahead log, see wal.go
+	wal struct {
+		fp      *os.File
+		size    int64             // the end of the last record
+		mu      sync.RWMutex      // protects the index maps from the readers
+		pages   map[uint64][]byte // the pages that are only in the log, by pointer
+		running bool              // a background checkpoint is pending
+		v09     bool              // written before buckets, see DB_SIG_V09
+	}
+	// encryption, see crypt.go
+	crypt struct {
+		aead cipher.AEAD // nil without Options.Key
+		kcv  []byte      // the key-check value of the master page
 	}
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
-	return nil
 }
 
 // callback for BTree & FreeList, dereference a pointer.
-func (db *KV) pageGet(ptr uint64) BNode {
+func (db *KV) pageGet(ptr uint64) (BNode, error) {
 	if page, ok := db.page.updates[ptr]; ok {
-		utils.Assert(page != nil, "ERROR!")
-		return BNode{page} // for new pages
+		utils.Assert(page == nil, "pageGet: Page was deallocated!")
+		return BNode{page}, nil // for new pages
 	}
-	return pageGetMapped(db, ptr) // for written pages
+	// the master page is not a node, nor is anything past the written pages
+	if ptr == 0 || ptr >= db.page.flushed {
+		return BNode{}, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	if page, ok := walLookup(db, db.wal.pages, ptr); ok {
+		return pageDecode(page, ptr) // not checkpointed yet
+	}
+	if ptr == db.free.tailPage {
+		// the free list tail is updated in place. a torn write can break its checksum,
+		// but not the items that were already committed, see FreeList.PushTail.
+		// an encrypted one can't be read at all, see cryptRecover.
+		page, err := db.store.Read(ptr)
+		return BNode{page}, err
+	}
+	return pageRead(db.store, ptr) // for written pages
 }
 
-func pageGetMapped(db *KV, ptr uint64) BNode {
-	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
-		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
-		}
-		start = end
+// read a written page and verify its checksum
+func pageRead(store PageStore, ptr uint64) (BNode, error) {
+	page, err := store.Read(ptr)
+	if err != nil {
+		return BNode{}, err
 	}
-	panic("bad ptr")
+	sum := binary.LittleEndian.Uint32(page[BTREE_NODE_SIZE:])
+	if sum != pageChecksum(page) {
+		return BNode{}, fmt.Errorf("%w: bad checksum in page %d", ErrCorruptPage, ptr)
+	}
+	return pageDecode(page, ptr)
+}
+
+// the checksum of the page content, stored in the page trailer
+func pageChecksum(page []byte) uint32 {
+	return crc32.Checksum(page[:BTREE_NODE_SIZE], crcTable)
 }
 
-const DB_SIG = "BuildYourOwnDB06"
+const DB_SIG = "BuildYourOwnDB10"
+
+// the format before buckets, its master slots have no catalog.
+// it's read as it is and converted by the first KV.Open that can write.
+const DB_SIG_V09 = "BuildYourOwnDB09"
+
+// the format before page checksums, see Upgrade
+const DB_SIG_V08 = "BuildYourOwnDB08"
 
-// the master page format.
+// the master page holds 2 slots, and commits alternate between them,
+// so a torn write can only damage the slot that is being replaced.
+// the one with the highest txid that passes the checks is used.
+// the slot format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B | 8B | 8B |
+// | sig | txid | btree_root | page_used | free_list head | free_list tail | catalog | crc |
+// | 16B |  8B  |     8B     |    8B     |  page  |  seq  |  page  |  seq  |         | 4B  |
+// | 16B |  8B  |     8B     |    8B     |   8B   |  8B   |   8B   |  8B   |   8B    | 4B  |
+const MASTER_SLOT_SIZE = 16 + 8 + 8 + 8 + 32 + 8 + 4
+const MASTER_SLOT_SIZE_V09 = MASTER_SLOT_SIZE - 8
+
+// the 2 slots are put in different disk sectors
+const MASTER_SLOT_OFFSET = BTREE_PAGE_SIZE / 2
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// the content of a master slot
+type masterSlot struct {
+	txid    uint64
+	root    uint64
+	used    uint64
+	free    flData
+	catalog uint64 // the root of the bucket catalog, see bucket.go
+}
+
+// decode and verify a slot of a database with `npages` pages
+func masterDecode(data []byte, sig string, npages uint64) (masterSlot, error) {
+	size := MASTER_SLOT_SIZE
+	if sig != DB_SIG {
+		size = MASTER_SLOT_SIZE_V09 // the older formats have the same slots
+	}
+	data = data[:size]
+	slot := masterSlot{
+		txid: binary.LittleEndian.Uint64(data[16:]),
+		root: binary.LittleEndian.Uint64(data[24:]),
+		used: binary.LittleEndian.Uint64(data[32:]),
+		free: flData{
+			headPage: binary.LittleEndian.Uint64(data[40:]),
+			headSeq:  binary.LittleEndian.Uint64(data[48:]),
+			tailPage: binary.LittleEndian.Uint64(data[56:]),
+			tailSeq:  binary.LittleEndian.Uint64(data[64:]),
+		},
+	}
+	if sig == DB_SIG {
+		slot.catalog = binary.LittleEndian.Uint64(data[72:])
+	}
+	// verify the slot
+	if !bytes.Equal([]byte(sig), data[:16]) {
+		return masterSlot{}, fmt.Errorf("%w: bad signature", ErrCorruptPage)
+	}
+	crc := binary.LittleEndian.Uint32(data[size-4:])
+	if crc != crc32.Checksum(data[:size-4], crcTable) {
+		return masterSlot{}, fmt.Errorf("%w: bad master page checksum", ErrCorruptPage)
+	}
+	used, free := slot.used, slot.free
+	bad := !(1 <= used && used <= npages)
+	bad = bad || !(0 <= slot.root && slot.root < used)
+	bad = bad || !(0 <= slot.catalog && slot.catalog < used)
+	bad = bad || !(free.headPage < used && free.tailPage < used)
+	bad = bad || (free.headPage == 0) != (free.tailPage == 0)
+	bad = bad || free.headSeq > free.tailSeq
+	if bad {
+		return masterSlot{}, fmt.Errorf("%w: bad master page", ErrCorruptPage)
+	}
+	return slot, nil
+}
+
+// pick the newest valid slot of the master page, returns the slot and its index
+func masterPick(data []byte, sig string, npages uint64) (masterSlot, int, error) {
+	var slot masterSlot
+	var err error
+	idx := -1
+	for i := 0; i < 2; i++ {
+		cur, e := masterDecode(data[i*MASTER_SLOT_OFFSET:], sig, npages)
+		if e != nil {
+			if err == nil {
+				err = e // report the first slot
+			}
+			continue
+		}
+		if idx < 0 || cur.txid > slot.txid {
+			slot, idx = cur, i
+		}
+	}
+	if idx < 0 {
+		return masterSlot{}, 0, err
+	}
+	return slot, idx, nil
+}
+
 func masterLoad(db *KV) error {
-	if db.mmap.file == 0 {
+	npages := db.store.Size()
+	if npages == 0 {
 		// empty file, the master page will be created on the first write.
 		db.page.flushed = 1 // reserved for the master page
+		db.slot = 1         // the first commit goes to slot 0
 		return nil
 	}
-	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
-	// verify the page
-	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
-		return errors.New("Bad signature.")
+	data, err := db.store.Read(0)
+	if err != nil {
+		return err
 	}
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
-	bad = bad || !(0 <= root && root < used)
-	if bad {
-		return errors.New("Bad master page.")
+	// the slot of the current format is newer if there is one
+	slot, idx, err := masterPick(data, DB_SIG, npages)
+	if err != nil {
+		var e error
+		if slot, idx, e = masterPick(data, DB_SIG_V09, npages); e == nil {
+			err = nil
+			db.wal.v09 = true
+		}
 	}
-	db.tree.root = root
-	db.page.flushed = used
+	if err != nil {
+		if _, _, e := masterPick(data, DB_SIG_V08, npages); e == nil {
+			return fmt.Errorf("%w: use Upgrade to convert it", ErrOldFormat)
+		}
+		return err
+	}
+	db.txid = slot.txid
+	db.tree.root = slot.root
+	db.catalog.root = slot.catalog
+	db.free.flData = slot.free
+	db.page.flushed = slot.used
+	db.slot = idx
 	return nil
 }
 
-// update the master page. it must be atomic.
-func masterStore(db *KV) error {
-	var data [32]byte
+func masterEncode(slot masterSlot) [MASTER_SLOT_SIZE]byte {
+	var data [MASTER_SLOT_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	// NOTE: Updating the page via mmap is not atomic.
-	// Use the `pwrite()` syscall instead.
-	_, err := db.fp.WriteAt(data[:], 0)
+	binary.LittleEndian.PutUint64(data[16:], slot.txid)
+	binary.LittleEndian.PutUint64(data[24:], slot.root)
+	binary.LittleEndian.PutUint64(data[32:], slot.used)
+	binary.LittleEndian.PutUint64(data[40:], slot.free.headPage)
+	binary.LittleEndian.PutUint64(data[48:], slot.free.headSeq)
+	binary.LittleEndian.PutUint64(data[56:], slot.free.tailPage)
+	binary.LittleEndian.PutUint64(data[64:], slot.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[72:], slot.catalog)
+	crc := crc32.Checksum(data[:MASTER_SLOT_SIZE-4], crcTable)
+	binary.LittleEndian.PutUint32(data[MASTER_SLOT_SIZE-4:], crc)
+	return data
+}
+
+// update the master page. it must be atomic.
+// the slot written last is left untouched, the writes alternate between the slots.
+func masterStore(db *KV, slot masterSlot) error {
+	data := masterEncode(slot)
+	// the other slot is rewritten as it is, it's in another disk sector
+	old, err := db.store.Read(0)
 	if err != nil {
+		return err
+	}
+	page := make([]byte, BTREE_PAGE_SIZE)
+	copy(page, old)
+	copy(page[(1-db.slot)*MASTER_SLOT_OFFSET:], data[:])
+	copy(page[MASTER_KCV_OFFSET:], db.crypt.kcv) // the same bytes after the first time
+	if err := db.store.Write(0, page); err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
+	db.slot = 1 - db.slot
 	return nil
 }
 
+// write the master page of a DB_SIG_V09 file in the current format
+func masterConvert(db *KV) error {
+	if err := masterStore(db, masterCurrent(db)); err != nil {
+		return err
+	}
+	if err := walFsync(db, db.store.Sync); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	db.wal.v09 = false
+	return nil
+}
+
+// the master page of the in-memory state
+func masterCurrent(db *KV) masterSlot {
+	return masterSlot{
+		txid:    db.txid,
+		root:    db.tree.root,
+		used:    db.page.flushed,
+		free:    db.free.flData,
+		catalog: db.catalog.root,
+	}
+}
+
 // callback for BTree, allocate a new page.
-func (db *KV) pageNew(node BNode) uint64 {
-	utils.Assert(len(node.data) <= BTREE_PAGE_SIZE, "ERROR!")
-	ptr := uint64(0)
-	if db.page.nfree < db.free.Total() {
-		// reuse a deallocated page
-		ptr = db.free.Get(db.page.nfree)
-		db.page.nfree++
-	} else {
-		// append a new page
-		ptr = db.page.flushed + uint64(db.page.nappend)
-		db.page.nappend++
+func (db *KV) pageNew(node BNode) (uint64, error) {
+	utils.Assert(len(node.data) > BTREE_PAGE_SIZE, "pageNew: Node too large!")
+	// reuse a deallocated page
+	ptr, err := db.free.PopHead()
+	if err != nil {
+		return 0, err
+	}
+	if ptr == 0 {
+		return db.pageAppend(node) // or append a new page
 	}
 	db.page.updates[ptr] = node.data
-	return ptr
+	return ptr, nil
 }
 
 // callback for BTree, deallocate a page.
-func (db *KV) pageDel(ptr uint64) {
+func (db *KV) pageDel(ptr uint64) error {
 	db.page.updates[ptr] = nil
+	return db.free.PushTail(ptr)
 }
 
 // callback for FreeList, allocate a new page.
-func (db *KV) pageAppend(node BNode) uint64 {
-	utils.Assert(len(node.data) <= BTREE_PAGE_SIZE, "ERROR")
+func (db *KV) pageAppend(node BNode) (uint64, error) {
+	utils.Assert(len(node.data) > BTREE_PAGE_SIZE, "pageAppend: Node too large!")
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
 	db.page.updates[ptr] = node.data
-	return ptr
+	return ptr, nil
 }
 
-// callback for FreeList, reuse a page.
-func (db *KV) pageUse(ptr uint64, node BNode) {
-	db.page.updates[ptr] = node.data
-}
-
-// extend the file to at least `npages`.
-func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
-	if filePages >= npages {
-		return nil
+// callback for FreeList, update an existing page in place.
+func (db *KV) pageWrite(ptr uint64) (BNode, error) {
+	if page, ok := db.page.updates[ptr]; ok {
+		utils.Assert(page == nil, "pageWrite: Page was deallocated!")
+		return BNode{page}, nil // already updated
 	}
-	for filePages < npages {
-		// the file size is increased exponentially,
-		// so that we don't have to extend the file for every update.
-		inc := filePages / 8
-		if inc < 1 {
-			inc = 1
-		}
-		filePages += inc
-
+	if ptr == 0 || ptr >= db.page.flushed {
+		return BNode{}, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
 	}
-	fileSize := filePages * BTREE_PAGE_SIZE
-	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
-	if err != nil {
-		return fmt.Errorf("fallocate: %w", err)
+	// not verified, it's either the free list tail or a free page to be overwritten.
+	// a free page is overwritten as a whole, a torn one might not be readable.
+	page := make([]byte, BTREE_PAGE_SIZE)
+	if ptr == db.free.tailPage {
+		data, ok := walLookup(db, db.wal.pages, ptr)
+		if !ok {
+			var err error
+			if data, err = db.store.Read(ptr); err != nil {
+				return BNode{}, err
+			}
+		}
+		copy(page, data)
 	}
-	db.mmap.file = fileSize
-	return nil
+	db.page.updates[ptr] = page
+	return BNode{page}, nil
 }
 
 func (db *KV) Open() error {
+	// a custom store takes care of its own locking
+	if db.Options.Store == nil {
+		lock, err := lockFile(db.Path, !db.Options.ReadOnly)
+		if err != nil {
+			return fmt.Errorf("KV.Open: %w", err)
+		}
+		db.lock = lock
+	}
+	// a wrong key is found before anything is read
+	if err := cryptInit(db); err != nil {
+		lockRelease(db)
+		return fmt.Errorf("KV.Open: %w", err)
+	}
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	store, err := openStore(db, db.Path)
 	if err != nil {
-		return fmt.Errorf("OpenFile: %w", err)
+		lockRelease(db)
+		return fmt.Errorf("KV.Open: %w", err)
 	}
-	db.fp = fp
-	// create the initial mmap
-	sz, chunk, err := mmapInit(db.fp)
-	if err != nil {
-		goto fail
-	}
-	db.mmap.file = sz
-	db.mmap.total = len(chunk)
-	db.mmap.chunks = [][]byte{chunk}
+	db.store = store
 	// btree callbacks
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
 	db.tree.del = db.pageDel
+	db.catalog.get = db.pageGet
+	db.catalog.new = db.pageNew
+	db.catalog.del = db.pageDel
+	// free list callbacks
+	db.free.get = db.pageGet
+	db.free.new = db.pageAppend
+	db.free.set = db.pageWrite
+	// pages to be written on the next flush
+	db.page.updates = map[uint64][]byte{}
 	// read the master page
 	err = masterLoad(db)
 	if err != nil {
 		goto fail
 	}
+	// apply the commits that are only in the log
+	err = walOpen(db)
+	if err != nil {
+		goto fail
+	}
+	// the log is empty by now, and new records have the catalog
+	if db.wal.v09 && !db.Options.ReadOnly {
+		if err = masterConvert(db); err != nil {
+			goto fail
+		}
+	}
+	// a torn free list tail of an encrypted file
+	if err = cryptRecover(db); err != nil {
+		goto fail
+	}
+	// no readers yet, everything in the free list can be reused
+	db.free.maxSeq = db.free.tailSeq
+	db.readers = map[uint64]int{}
+	db.sync.cond.L = &db.sync.mu
+	kvSynced(db, kvPublish(db))
 	// done
 	return nil
 fail:
@@ -231,78 +468,242 @@ fail:
 }
 
 // cleanups
-func (db *KV) Close() {
-	for _, chunk := range db.mmap.chunks {
-		err := syscall.Munmap(chunk)
-		utils.Assert(err == nil, "ERROR!")
+func (db *KV) Close() error {
+	// wait for the write transaction, readers must be done by now
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.store == nil {
+		return ErrClosed
+	}
+	// wait for the commits that are still syncing
+	err := kvSyncAll(db)
+	if err == nil && db.wal.fp == nil && db.Options.Sync == SyncNormal && !db.Options.ReadOnly {
+		// the last master page
+		if err = db.store.Sync(); err != nil {
+			err = fmt.Errorf("fsync: %w", err)
+		}
+	}
+	if db.wal.fp != nil {
+		// leave everything in the main file
+		if e := walCheckpoint(db); e != nil && err == nil {
+			err = e
+		}
+		if e := db.wal.fp.Close(); e != nil && err == nil {
+			err = e
+		}
+		db.wal.fp = nil
+	}
+	db.mu.Lock()
+	db.commit.store = nil // no new readers
+	retired := db.retired
+	db.retired = nil
+	db.mu.Unlock()
+	for _, r := range retired {
+		r.store.Close() // the file is gone anyway
+	}
+	if e := db.store.Close(); e != nil && err == nil {
+		err = e
+	}
+	db.store = nil
+	lockRelease(db)
+	return err
+}
+
+// let other processes open the file. closing the file releases the flock.
+func lockRelease(db *KV) {
+	if db.lock != nil {
+		db.lock.Close()
+		db.lock = nil
+	}
+}
+
+// read the db from the latest version
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	reader, err := db.BeginRead()
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.EndRead()
+	val, ok, err := reader.Get(key)
+	// the page can be reused once the reader is gone
+	return bytes.Clone(val), ok, err
+}
+
+// range iterator over the db, see KV.Scan
+type KVIter struct {
+	iter   *BIter
+	end    []byte    // exclusive upper bound, nil for no bound
+	reader *KVReader // released by Close, nil if owned by the caller
+}
+
+// is the iterator positioned at a key inside the range?
+func (it *KVIter) Valid() bool {
+	if !it.iter.Valid() {
+		return false
+	}
+	key := it.iter.key()
+	return it.end == nil || bytes.Compare(key, it.end) < 0
+}
+
+// get the current KV pair
+func (it *KVIter) Deref() ([]byte, []byte) {
+	return it.iter.Deref()
+}
+
+// move to the next key
+func (it *KVIter) Next() {
+	it.iter.Next()
+}
+
+// the error that stopped the iterator, if any
+func (it *KVIter) Err() error {
+	return it.iter.Err()
+}
+
+// release the version pinned by KV.Scan.
+// the keys and values returned by the iterator are not valid after that.
+func (it *KVIter) Close() {
+	if it.reader != nil {
+		it.reader.EndRead()
+		it.reader = nil
+	}
+}
+
+// iterate over the keys in [start, end) of the latest version in order.
+// a nil end scans to the last key.
+// the version is pinned until the iterator is closed.
+func (db *KV) Scan(start []byte, end []byte) *KVIter {
+	reader, err := db.BeginRead()
+	if err != nil {
+		return &KVIter{iter: &BIter{err: err}}
 	}
-	_ = db.fp.Close()
+	iter := reader.Scan(start, end)
+	iter.reader = reader
+	return iter
 }
 
-// read the db
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// the in-memory copy of the master page, kept to revert a failed update
+type kvMaster struct {
+	txid    uint64
+	root    uint64
+	catalog uint64
+	flushed uint64
+	free    flData
 }
 
-// update the db
+func masterSave(db *KV) kvMaster {
+	return kvMaster{
+		txid:    db.txid,
+		root:    db.tree.root,
+		catalog: db.catalog.root,
+		flushed: db.page.flushed,
+		free:    db.free.flData,
+	}
+}
+
+// go back to the last saved state and discard the pending pages
+func masterRevert(db *KV, saved kvMaster) {
+	// the next commit goes to the same slot, a failed one might have reached the disk
+	db.txid = saved.txid
+	db.tree.root = saved.root
+	db.catalog.root = saved.catalog
+	db.page.flushed = saved.flushed
+	db.free.flData = saved.free
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+}
+
+// make the state written by the last commit visible to new readers.
+// returns the new version.
+func kvPublish(db *KV) uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.commit.version++
+	db.commit.master = masterCurrent(db)
+	db.commit.store = db.store
+	db.commit.wal = db.wal.pages
+	return db.commit.version
+}
+
+// update the db in a transaction of its own
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return flushPages(db)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(key, val); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// update the db depending on the mode of the request in a transaction of its own
+func (db *KV) Update(req *UpdateReq) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	updated, err := tx.Update(req)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return updated, tx.Commit()
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	deleted, err := tx.Del(key)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return deleted, tx.Commit()
 }
 
-// persist the newly allocated pages after updates
+// write the newly allocated pages after updates.
+// they are made durable by kvSync after the commit.
 func flushPages(db *KV) error {
+	if db.Options.WAL {
+		return walWrite(db)
+	}
 	if err := writePages(db); err != nil {
 		return err
 	}
-	return syncPages(db)
+	db.txid++
+	db.page.flushed += uint64(db.page.nappend)
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	return nil
 }
 
 func writePages(db *KV) error {
-	// update the free list
-	freed := []uint64{}
-	for ptr, page := range db.page.updates {
-		if page == nil {
-			freed = append(freed, ptr)
-		}
-	}
-	db.free.Update(db.page.nfree, freed)
-
-	// extend the file & mmap if needed
-	npages := int(db.page.flushed) + len(db.page.temp)
-	if err := extendFile(db, npages); err != nil {
-		return err
-	}
-	if err := extendMmap(db, npages); err != nil {
+	// extend the file if needed
+	npages := db.page.flushed + uint64(db.page.nappend)
+	if err := db.store.Grow(npages); err != nil {
 		return err
 	}
 	// copy pages to the file
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(pageGetMapped(db, ptr).data, page)
+			if err := db.store.Write(ptr, pageSeal(db, page)); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func syncPages(db *KV) error {
-	// flush data to the disk. must be done before updating the master page.
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+// the node as a whole page to be written, compressed and with its checksum
+func pageSeal(db *KV, node []byte) []byte {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	if !pageCompress(db.Options.Compress, page, node) {
+		copy(page, node[:BTREE_NODE_SIZE])
 	}
-	db.page.flushed += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
-	// update & flush the master page
-	if err := masterStore(db); err != nil {
-		return err
-	}
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
-	}
-	return nil
+	binary.LittleEndian.PutUint32(page[BTREE_NODE_SIZE:], pageChecksum(page))
+	return page
 }
@@ -0,0 +1,266 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// compare the KV with the reference map, by lookups and by a scan
+func kvCheck(t *testing.T, db *KV, ref map[string]string) {
+	t.Helper()
+	keys := []string{}
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok, err := db.Get([]byte(k))
+		if err != nil || !ok || string(v) != ref[k] {
+			t.Fatalf("get %q: %v", k, err)
+		}
+	}
+	i := 0
+	it := db.Scan(nil, nil)
+	for ; it.Valid(); it.Next() {
+		k, _ := it.Deref()
+		if i >= len(keys) || string(k) != keys[i] {
+			t.Fatalf("scan %d: %q", i, k)
+		}
+		i++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	if i != len(keys) {
+		t.Fatal("scan count", i, len(keys))
+	}
+}
+
+// random updates of the same keys, the freed pages are reused
+func TestKVReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(1))
+	sizes := []uint64{}
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 3000; i++ {
+			k := fmt.Sprintf("k%06d", r.Intn(2000))
+			v := string(bytes.Repeat([]byte{'v'}, r.Intn(500)))
+			if r.Intn(3) == 0 {
+				delete(ref, k)
+				if _, err := db.Del([]byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				ref[k] = v
+				if err := db.Set([]byte(k), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		kvCheck(t, db, ref)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = &KV{Path: path}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		kvCheck(t, db, ref)
+		sizes = append(sizes, db.page.flushed)
+	}
+	if sizes[5] > 2*sizes[1] {
+		t.Fatal("the file keeps growing", sizes)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func masterTear(t *testing.T, path string, slots ...int) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	for _, slot := range slots {
+		if _, err := fp.WriteAt([]byte{0xff, 0xff}, int64(slot)*MASTER_SLOT_OFFSET+30); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a torn master slot falls back to the other one
+func TestMasterSlots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte{byte('a' + i)}, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txid, slot := db.txid, db.slot
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	masterTear(t, path, slot)
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if db.txid != txid-1 || db.slot == slot {
+		t.Fatal("bad slot", db.txid, db.slot)
+	}
+	_, ok1, _ := db.Get([]byte("i"))
+	_, ok2, _ := db.Get([]byte("j"))
+	if !ok1 || ok2 {
+		t.Fatal("not the previous commit", ok1, ok2)
+	}
+	// the next commit goes to the torn slot
+	if err := db.Set([]byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.txid != txid || db.slot != slot {
+		t.Fatal("bad slot", db.txid, db.slot)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	masterTear(t, path, 0, 1)
+	db = &KV{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrCorruptPage) {
+		db.Close()
+		t.Fatal("both slots torn", err)
+	}
+}
+
+func TestUpdateModes(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	req := &UpdateReq{Key: []byte("k"), Val: []byte("v1"), Mode: MODE_UPDATE_ONLY}
+	if ok, err := db.Update(req); ok || err != nil || req.Old != nil {
+		t.Fatal("update a missing key", ok, err)
+	}
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("v1"), Mode: MODE_INSERT_ONLY}
+	if ok, err := db.Update(req); !ok || err != nil || !req.Added || !req.Updated {
+		t.Fatal("insert", ok, err)
+	}
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("v2"), Mode: MODE_INSERT_ONLY}
+	if ok, err := db.Update(req); ok || err != nil || string(req.Old) != "v1" {
+		t.Fatal("insert an existing key", ok, err)
+	}
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("v2")}
+	if ok, err := db.Update(req); !ok || err != nil || req.Added || string(req.Old) != "v1" {
+		t.Fatal("upsert", ok, err)
+	}
+	// the same value is not written again
+	req = &UpdateReq{Key: []byte("k"), Val: []byte("v2"), Mode: MODE_UPDATE_ONLY}
+	if ok, err := db.Update(req); ok || err != nil || req.Updated || string(req.Old) != "v2" {
+		t.Fatal("update to the same value", ok, err)
+	}
+	// the old value of an overflow chain
+	if err := db.Set([]byte("big"), make([]byte, 10000)); err != nil {
+		t.Fatal(err)
+	}
+	req = &UpdateReq{Key: []byte("big"), Val: []byte("s")}
+	if ok, err := db.Update(req); !ok || err != nil || len(req.Old) != 10000 {
+		t.Fatal("replace a large value", ok, err)
+	}
+	// a request that the mode rejects leaves no page behind
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []int{MODE_INSERT_ONLY, MODE_UPDATE_ONLY} {
+		req = &UpdateReq{Key: []byte("big"), Val: make([]byte, 20000), Mode: mode}
+		if mode == MODE_UPDATE_ONLY {
+			req.Key = []byte("none")
+		}
+		if ok, err := tx.Update(req); ok || err != nil || len(db.page.updates) != 0 {
+			t.Fatal("rejected update", mode, ok, err, len(db.page.updates))
+		}
+	}
+	tx.Abort()
+	if _, err := db.Update(&UpdateReq{Key: []byte("k"), Mode: 9}); !errors.Is(err, ErrBadMode) {
+		t.Fatal("bad mode", err)
+	}
+	res, err := db.Verify()
+	if err != nil || !res.OK() {
+		t.Fatal(err, res.Errors)
+	}
+}
+
+func TestKVScan(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i += 2 {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		start, end  string
+		first, last int // -1 for an empty range
+	}{
+		{"", "", 0, 998},
+		{"k0010", "k0020", 10, 18},
+		{"k0011", "k0021", 12, 20},
+		{"k0990", "", 990, 998},
+		{"", "k0004", 0, 2},
+		{"k0020", "k0020", -1, -1},
+		{"k0020", "k0010", -1, -1},
+		{"k0011", "k0012", -1, -1},
+		{"k0999", "", -1, -1},
+		{"", "k0000", -1, -1},
+	}
+	for _, c := range cases {
+		var start, end []byte
+		if c.start != "" {
+			start = []byte(c.start)
+		}
+		if c.end != "" {
+			end = []byte(c.end)
+		}
+		got := []int{}
+		it := db.Scan(start, end)
+		for ; it.Valid(); it.Next() {
+			k, _ := it.Deref()
+			var n int
+			fmt.Sscanf(string(k), "k%d", &n)
+			got = append(got, n)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		it.Close()
+		if c.first < 0 {
+			if len(got) != 0 {
+				t.Fatal("not empty", c.start, c.end, got)
+			}
+			continue
+		}
+		if len(got) != (c.last-c.first)/2+1 || got[0] != c.first || got[len(got)-1] != c.last {
+			t.Fatal("bad range", c.start, c.end, got)
+		}
+	}
+}
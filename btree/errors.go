@@ -0,0 +1,41 @@
+package btree
+
+import "errors"
+
+// errors returned for bad input or a bad database file.
+// they can be wrapped with more context, match them with errors.Is.
+var (
+	ErrEmptyKey       = errors.New("Empty key")
+	ErrKeyTooLarge    = errors.New("Key length greater than maximum")
+	ErrValueTooLarge  = errors.New("Val length greater than maximum")
+	ErrCorruptPage    = errors.New("Corrupt page")
+	ErrClosed         = errors.New("Database is closed")
+	ErrTxDone         = errors.New("Transaction is already committed or aborted")
+	ErrOldFormat      = errors.New("Database file is in an old format")
+	ErrWrongKey       = errors.New("Wrong encryption key")
+	ErrLocked         = errors.New("Database is locked by another process")
+	ErrReadOnly       = errors.New("Database is read-only")
+	ErrBucketExists   = errors.New("Bucket already exists")
+	ErrBucketNotFound = errors.New("Bucket not found")
+	ErrBadMode        = errors.New("Bad update mode")
+	ErrPoolFull       = errors.New("Every page of the buffer pool is pinned")
+)
+
+// validate a key before looking it up or updating it
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// validate a value before storing it
+func checkVal(val []byte) error {
+	if len(val) > BTREE_MAX_BIG_VAL_SIZE {
+		return ErrValueTooLarge
+	}
+	return nil
+}
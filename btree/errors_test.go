@@ -0,0 +1,67 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(nil, []byte("x")); !errors.Is(err, ErrEmptyKey) {
+		t.Fatal("empty key", err)
+	}
+	if err := db.Set(make([]byte, BTREE_MAX_KEY_SIZE+1), []byte("x")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatal("large key", err)
+	}
+	if err := db.Set([]byte("a"), make([]byte, BTREE_MAX_BIG_VAL_SIZE+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatal("large value", err)
+	}
+	if _, _, err := db.Get(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatal("empty key", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprint(i)), make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := db.tree.root
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Get([]byte("a")); !errors.Is(err, ErrClosed) {
+		t.Fatal("closed", err)
+	}
+
+	// a corrupt root fails every operation instead of panicking
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte{9, 9}, int64(root)*BTREE_PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, _, err := db.Get([]byte("1")); !errors.Is(err, ErrCorruptPage) {
+		t.Fatal("get", err)
+	}
+	if err := db.Set([]byte("1"), nil); !errors.Is(err, ErrCorruptPage) {
+		t.Fatal("set", err)
+	}
+	it := db.Scan([]byte("1"), nil)
+	if it.Valid() || !errors.Is(it.Err(), ErrCorruptPage) {
+		t.Fatal("scan", it.Err())
+	}
+	it.Close()
+}
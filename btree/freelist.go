@@ -1,105 +1,202 @@
 package btree
 
-import "github.com/abedmohammed/goDB/utils"
+import (
+	"encoding/binary"
+	"fmt"
 
+	"github.com/abedmohammed/goDB/utils"
+)
+
+// the free list is a queue of unused pages, stored as a linked list of nodes.
+// freed pages are pushed to the tail and reused pages are popped from the head,
+// so the pages freed last are the last ones to be reused.
+// every item has a sequence number, which is turned into a position in its node.
+//
+// the free list node format.
+// | type | unused | next | pointers |
+// |  2B  |   2B   |  8B  |  cap*8B  |
 const BNODE_FREE_LIST = 3
-const FREE_LIST_HEADER = 4 + 8 + 8
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+const FREE_LIST_HEADER = 4 + 8
+const FREE_LIST_CAP = (BTREE_NODE_SIZE - FREE_LIST_HEADER) / 8
+
+// the part of the free list persisted in the master page
+type flData struct {
+	headPage uint64 // the node to pop items from
+	headSeq  uint64 // sequence number of the first item
+	tailPage uint64 // the node to push items to
+	tailSeq  uint64 // sequence number after the last item
+}
 
 type FreeList struct {
-	head uint64
+	flData
+	// items from maxSeq on can't be consumed yet, they might still be in use
+	maxSeq uint64
+	// the list tail after each recent commit, see FreeList.SetMaxSeq
+	commits []flCommit
 	// callbacks for managing on-disk pages
-	get func(uint64) BNode  // dereference a pointer
-	new func(BNode) uint64  // append a new page
-	use func(uint64, BNode) // reuse a page
+	get func(uint64) (BNode, error) // dereference a pointer
+	new func(BNode) (uint64, error) // append a new page
+	set func(uint64) (BNode, error) // update an existing page in place
+}
+
+type flCommit struct {
+	version uint64 // the version created by the commit
+	tailSeq uint64 // the list tail after the commit
 }
 
-func flnSize(node BNode) int
-func flnNext(node BNode) uint64
-func flnPtr(node BNode, idx int)
-func flnSetPtr(node BNode, idx int, ptr uint64)
-func flnSetHeader(node BNode, size uint16, next uint64)
-func flnSetTotal(node BNode, total uint64)
+// position of an item in its node
+func seq2idx(seq uint64) int {
+	return int(seq % FREE_LIST_CAP)
+}
+
+// returns pointer to the next node in the list
+func flnNext(node BNode) uint64 {
+	return binary.LittleEndian.Uint64(node.data[4:12])
+}
+
+// update pointer to the next node in the list
+func flnSetNext(node BNode, next uint64) {
+	binary.LittleEndian.PutUint64(node.data[4:12], next)
+}
+
+// returns the free page pointer at given index
+func flnPtr(node BNode, idx int) uint64 {
+	utils.Assert(idx < 0 || idx >= FREE_LIST_CAP, "flnPtr: Index out of bounds!")
+	pos := FREE_LIST_HEADER + 8*idx
+	return binary.LittleEndian.Uint64(node.data[pos:])
+}
+
+// update the free page pointer at given index
+func flnSetPtr(node BNode, idx int, ptr uint64) {
+	utils.Assert(idx < 0 || idx >= FREE_LIST_CAP, "flnSetPtr: Index out of bounds!")
+	pos := FREE_LIST_HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node.data[pos:], ptr)
+}
+
+// turn a page into an empty node
+func flnInit(node BNode) {
+	clear(node.data)
+	binary.LittleEndian.PutUint16(node.data[0:2], BNODE_FREE_LIST)
+}
+
+// dereference a free list node and check its type
+func flGet(fl *FreeList, ptr uint64) (BNode, error) {
+	node, err := fl.get(ptr)
+	if err != nil {
+		return BNode{}, err
+	}
+	if node.btype() != BNODE_FREE_LIST {
+		return BNode{}, fmt.Errorf("%w: bad free list node %d", ErrCorruptPage, ptr)
+	}
+	return node, nil
+}
 
 // number of items in the list
-func (fl *FreeList) Total() int
-
-// get the nth pointer
-func (fl *FreeList) Get(topn int) uint64 {
-	utils.Assert(0 <= topn && topn < fl.Total(), "ERROR")
-	node := fl.get(fl.head)
-	for flnSize(node) <= topn {
-		topn -= flnSize(node)
-		next := flnNext(node)
-		utils.Assert(next != 0, "ERROR")
-		node = fl.get(next)
+func (fl *FreeList) Total() int {
+	return int(fl.tailSeq - fl.headSeq)
+}
+
+// make the items pushed by the commits up to `version` available.
+// a reader of an older version might still see the pages freed after it.
+func (fl *FreeList) SetMaxSeq(version uint64) {
+	for len(fl.commits) > 0 && fl.commits[0].version <= version {
+		fl.maxSeq = fl.commits[0].tailSeq
+		fl.commits = fl.commits[1:]
+	}
+}
+
+// remember the list tail after a commit, see FreeList.SetMaxSeq
+func (fl *FreeList) Commit(version uint64) {
+	fl.commits = append(fl.commits, flCommit{version: version, tailSeq: fl.tailSeq})
+}
+
+// remove 1 item from the head node, and remove the head node if it's used up.
+// returns 0 when no item can be consumed.
+func flPop(fl *FreeList) (ptr uint64, head uint64, err error) {
+	if fl.headSeq == fl.maxSeq {
+		return 0, 0, nil // cannot advance
+	}
+	node, err := flGet(fl, fl.headPage)
+	if err != nil {
+		return 0, 0, err
 	}
-	return flnPtr(node, flnSize(node)-topn-1)
+	ptr = flnPtr(node, seq2idx(fl.headSeq))
+	fl.headSeq++
+	// move to the next node if the head node is used up
+	if seq2idx(fl.headSeq) == 0 {
+		head, fl.headPage = fl.headPage, flnNext(node)
+		if fl.headPage == 0 {
+			return 0, 0, fmt.Errorf("%w: unexpected end of free list", ErrCorruptPage)
+		}
+	}
+	return ptr, head, nil
 }
 
-// remove `popn` pointers and add some new pointers
-func (fl *FreeList) Update(popn int, freed []uint64) {
-	utils.Assert(popn <= fl.Total(), "ERROR")
-	if popn == 0 && len(freed) == 0 {
-		return // nothing to do
+// get 1 item from the list head. returns 0 when the list has nothing to offer.
+func (fl *FreeList) PopHead() (uint64, error) {
+	ptr, head, err := flPop(fl)
+	if err != nil {
+		return 0, err
 	}
-	// prepare to construct the new list
-	total := fl.Total()
-	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
-		node := fl.get(fl.head)
-		freed = append(freed, fl.head) // recyle the node itself
-		if popn >= flnSize(node) {
-			// phase 1
-			// remove all pointers in this node
-			popn -= flnSize(node)
-		} else {
-			// phase 2:
-			// remove some pointers
-			remain := flnSize(node) - popn
-			popn = 0
-			// reuse pointers from the free list itself
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
-				remain--
-				reuse = append(reuse, flnPtr(node, remain))
-			}
-			// move the node into the `freed` list
-			for i := 0; i < remain; i++ {
-				freed = append(freed, flnPtr(node, i))
-			}
+	if head != 0 {
+		// the used up head node is recycled
+		if err := fl.PushTail(head); err != nil {
+			return 0, err
 		}
-		// discard the node and move to the next node
-		total -= flnSize(node)
-		fl.head = flnNext(node)
 	}
-	utils.Assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0, "ERROR")
-	// phase 3: prepend new nodes
-	flPush(fl, freed, reuse)
-	// done
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
-}
-
-func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
-	for len(freed) > 0 {
-		new := BNode{make([]byte, BTREE_PAGE_SIZE)}
-		// construct a new node
-		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
+	return ptr, nil
+}
+
+// add 1 item to the tail
+func (fl *FreeList) PushTail(ptr uint64) error {
+	if fl.tailPage == 0 {
+		// the first item ever, create the list
+		node := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		flnInit(node)
+		first, err := fl.new(node)
+		if err != nil {
+			return err
 		}
-		flnSetHeader(new, uint16(size), fl.head)
-		for i, ptr := range freed[:size] {
-			flnSetPtr(new, i, ptr)
+		fl.headPage, fl.tailPage = first, first
+	}
+	// add it to the tail node.
+	// only the bytes past the committed tail are changed,
+	// so updating the node in place doesn't disturb the committed list.
+	node, err := fl.set(fl.tailPage)
+	if err != nil {
+		return err
+	}
+	flnSetPtr(node, seq2idx(fl.tailSeq), ptr)
+	fl.tailSeq++
+	if seq2idx(fl.tailSeq) != 0 {
+		return nil
+	}
+	// the tail node is full, add a new tail node.
+	// try to reuse a page from the list head
+	next, head, err := flPop(fl) // may remove the head node
+	if err != nil {
+		return err
+	}
+	if next != 0 {
+		tail, err := fl.set(next)
+		if err != nil {
+			return err
 		}
-		freed = freed[size:]
-		if len(reuse) > 0 {
-			// reuse a pointer from the list
-			fl.head, reuse = reuse[0], reuse[1:]
-			fl.use(fl.head, new)
-		} else {
-			// or append a page to house the new node
-			fl.head = fl.new(new)
+		flnInit(tail)
+	} else {
+		// or allocate a new node by appending
+		tail := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		flnInit(tail)
+		if next, err = fl.new(tail); err != nil {
+			return err
 		}
 	}
-	utils.Assert(len(reuse) == 0, "ERROR")
+	// link to the new tail node
+	flnSetNext(node, next)
+	fl.tailPage = next
+	// also add the head node if it's removed
+	if head != 0 {
+		return fl.PushTail(head)
+	}
+	return nil
 }
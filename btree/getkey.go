@@ -0,0 +1,48 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// recursive function to look up a key in the tree
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool, error) {
+	// find the kid node whose range covers the key
+	idx := nodeLookupLE(node, key)
+
+	switch node.btype() {
+	case BNODE_LEAF: // if leaf
+		if !bytes.Equal(key, node.getKey(idx)) {
+			return nil, false, nil // key not found
+		}
+		val, err := leafGetVal(tree, node, idx)
+		if err != nil {
+			return nil, false, err
+		}
+		return val, true, nil
+	case BNODE_NODE: // if internal
+		kid, err := tree.get(node.getPtr(idx))
+		if err != nil {
+			return nil, false, err
+		}
+		return treeGet(tree, kid, key)
+	default:
+		return nil, false, fmt.Errorf("%w: bad node type %d", ErrCorruptPage, node.btype())
+	}
+}
+
+// point lookup interface
+func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+
+	if tree.root == 0 {
+		return nil, false, nil // empty tree
+	}
+	root, err := tree.get(tree.root)
+	if err != nil {
+		return nil, false, err
+	}
+	return treeGet(tree, root, key)
+}
@@ -3,49 +3,55 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/abedmohammed/goDB/utils"
 )
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
-// TODO: bisect
 func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys() // get how many keys in node
-	found := uint16(0)    // initialize to first key
-
-	// start at index 1, if key is greater than current index in node, quit (meaning to add in that index and push everything up)
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		if cmp >= 0 {
-			break
+	// the first key is copied from the parent node,
+	// thus it's always less than or equal to the key.
+	// bisect the rest for the first key that is greater than the key
+	lo, hi := uint16(1), node.nkeys() // search in [lo, hi)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if bytes.Compare(node.getKey(mid), key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo - 1 // the key before it is the last one that is <= key
 }
 
-// add a new key to a leaf node
-func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+// add a new key to a leaf node.
+// `ref` marks the value as a reference to overflow pages.
+func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte, ref bool) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
-	nodeAppendRange(new, old, 0, 0, idx)                   //copy everything from old node to new up until index
-	nodeAppendKV(new, idx, 0, key, val)                    //add new kv to new node
+	nodeAppendRange(new, old, 0, 0, idx) //copy everything from old node to new up until index
+	nodeAppendKV(new, idx, 0, key, val)  //add new kv to new node
+	if ref {
+		new.setValRef(idx)
+	}
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx) //copy everything remaining from index of old to new node starting after the inserted kv
 }
 
 // add a new key to a leaf node
-func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte, ref bool) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
-	nodeAppendRange(new, old, 0, 0, idx)                         //copy everything from old node to new up until index
-	nodeAppendKV(new, idx, 0, key, val)                          //add new kv to new node
+	nodeAppendRange(new, old, 0, 0, idx) //copy everything from old node to new up until index
+	nodeAppendKV(new, idx, 0, key, val)  //add new kv to new node
+	if ref {
+		new.setValRef(idx)
+	}
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1)) //copy everything remaining from index of old to new node starting after the inserted kv
 }
 
 // copy multiple KVs into the position
 func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
-	utils.Assert(srcOld+n <= old.nkeys(), "nodeAppendRange: Index out of bounds!")
-	utils.Assert(dstNew+n <= new.nkeys(), "nodeAppendRange: Index out of bounds!")
+	utils.Assert(srcOld+n > old.nkeys(), "nodeAppendRange: Index out of bounds!")
+	utils.Assert(dstNew+n > new.nkeys(), "nodeAppendRange: Index out of bounds!")
 
 	if n == 0 {
 		return
@@ -85,60 +91,143 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 // insert a KV into a node, the result might be split into 2 nodes.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// the mode of the request is applied at the leaf, which also gives the old value
+// if `keepOld` is set. the result is an empty node if nothing is changed.
+func treeInsert(tree *BTree, node BNode, req *UpdateReq, keepOld bool) (BNode, error) {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
 	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
 
 	// where to insert the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(node, req.Key)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
-			// found the key, update it.
-			leafUpdate(new, node, idx, key, val)
+		found := bytes.Equal(req.Key, node.getKey(idx))
+		if found && keepOld {
+			old, err := leafGetVal(tree, node, idx)
+			if err != nil {
+				return BNode{}, err
+			}
+			// the page of the old value is freed by the update
+			req.Old = bytes.Clone(old)
+		}
+		if found && req.Mode == MODE_INSERT_ONLY || !found && req.Mode == MODE_UPDATE_ONLY {
+			return BNode{}, nil
+		}
+		if found && keepOld && bytes.Equal(req.Old, req.Val) {
+			return BNode{}, nil
+		}
+		val, ref, err := leafVal(tree, req.Val)
+		if err != nil {
+			return BNode{}, err
+		}
+		if found {
+			// found the key, update it and drop the old overflow pages.
+			if node.isValRef(idx) {
+				if err := overflowFree(tree, node.getVal(idx)); err != nil {
+					return BNode{}, err
+				}
+			}
+			leafUpdate(new, node, idx, req.Key, val, ref)
 		} else {
 			// insert it after the position.
-			leafInsert(new, node, idx+1, key, val)
+			leafInsert(new, node, idx+1, req.Key, val, ref)
 		}
+		req.Added, req.Updated = !found, true
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
-		nodeInsert(tree, new, node, idx, key, val)
+		changed, err := nodeInsert(tree, new, node, idx, req, keepOld)
+		if err != nil || !changed {
+			return BNode{}, err
+		}
 	default:
-		panic("bad node!")
+		return BNode{}, fmt.Errorf("%w: bad node type %d", ErrCorruptPage, node.btype())
+	}
+	return new, nil
+}
+
+// the value to store in a leaf.
+// a large value is replaced by a reference to its overflow pages.
+func leafVal(tree *BTree, val []byte) ([]byte, bool, error) {
+	if len(val) <= BTREE_MAX_VAL_SIZE {
+		return val, false, nil
 	}
-	return new
+	ref, err := overflowWrite(tree, val)
+	return ref, true, err
 }
 
-// part of the treeInsert(): KV insertion to an internal node
-func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, key []byte, val []byte) {
-	// get and deallocate the kid node
+// part of the treeInsert(): KV insertion to an internal node.
+// returns false if the kid is not changed.
+func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, req *UpdateReq, keepOld bool) (bool, error) {
 	kptr := node.getPtr(idx)
-	knode := tree.get(kptr)
-	tree.del(kptr)
+	knode, err := tree.get(kptr)
+	if err != nil {
+		return false, err
+	}
 	// recursive insertion to the kid node
-	knode = treeInsert(tree, knode, key, val)
+	knode, err = treeInsert(tree, knode, req, keepOld)
+	if err != nil || knode.data == nil {
+		return false, err
+	}
+	// deallocate the old kid node
+	if err := tree.del(kptr); err != nil {
+		return false, err
+	}
 	// split the result
 	nsplit, splited := nodeSplit3(knode)
 	// update the kid links
-	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+	return true, nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+}
+
+// size in bytes of a node holding the first n KVs of old
+func splitLeftBytes(old BNode, n uint16) uint16 {
+	return HEADER + 8*n + 2*n + old.getOffset(n)
+}
+
+// size in bytes of a node holding the KVs of old starting at n
+func splitRightBytes(old BNode, n uint16) uint16 {
+	return old.nbytes() - splitLeftBytes(old, n) + HEADER
 }
 
+// split an oversized node into 2 nodes balanced by bytes.
+// the right node always fits on a page, the left one might not.
 func nodeSplit2(left BNode, right BNode, old BNode) {
-	// code omitted...
+	utils.Assert(old.nkeys() < 2, "nodeSplit2: Not enough keys to split!")
+
+	// the initial guess: move keys to the left until both halves are about the same size
+	nleft := uint16(1)
+	for nleft+1 < old.nkeys() && splitLeftBytes(old, nleft) < splitRightBytes(old, nleft) {
+		nleft++
+	}
+	// try to fit the left half
+	for nleft > 1 && splitLeftBytes(old, nleft) > BTREE_NODE_SIZE {
+		nleft--
+	}
+	// the right half must fit on a page, the left half is split again if needed
+	for splitRightBytes(old, nleft) > BTREE_NODE_SIZE {
+		nleft++
+	}
+	utils.Assert(nleft >= old.nkeys(), "nodeSplit2: Right node is empty!")
+	nright := old.nkeys() - nleft
+
+	left.setHeader(old.btype(), nleft)
+	right.setHeader(old.btype(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	utils.Assert(right.nbytes() > BTREE_NODE_SIZE, "nodeSplit2: Right node too large!")
 }
 
 func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
+	if old.nbytes() <= BTREE_NODE_SIZE {
 		old.data = old.data[:BTREE_PAGE_SIZE]
 		return 1, [3]BNode{old}
 	}
 	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
 	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
+	if left.nbytes() <= BTREE_NODE_SIZE {
 		left.data = left.data[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right}
 	}
@@ -147,7 +236,7 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
 	nodeSplit2(leftleft, middle, left)
 
-	utils.Assert(leftleft.nbytes() <= BTREE_PAGE_SIZE, "nodeSplit3: Index out of bounds!")
+	utils.Assert(leftleft.nbytes() > BTREE_NODE_SIZE, "nodeSplit3: Index out of bounds!")
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
@@ -155,56 +244,145 @@ func nodeSplit3(old BNode) (uint16, [3]BNode) {
 func nodeReplaceKidN(
 	tree *BTree, new BNode, old BNode, idx uint16,
 	kids ...BNode,
-) {
+) error {
 	inc := uint16(len(kids))
 	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		ptr, err := tree.new(node)
+		if err != nil {
+			return err
+		}
+		nodeAppendKV(new, idx+uint16(i), ptr, node.getKey(0), nil)
 	}
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
+	return nil
 }
 
 func nodeReplace2Kid(new BNode, old BNode, idx uint16, merged uint64, key []byte) {
 	new.setHeader(BNODE_NODE, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, merged, key, nil)
-	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
 // insertion interface
 
-func (tree *BTree) Insert(key []byte, val []byte) {
+// insert a key or replace its value, see Update for the other modes
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	_, err := treeUpdate(tree, &UpdateReq{Key: key, Val: val}, false)
+	return err
+}
+
+// the update modes
+const (
+	MODE_UPSERT      = 0 // insert or replace
+	MODE_UPDATE_ONLY = 1 // only replace an existing key
+	MODE_INSERT_ONLY = 2 // only add a new key
+)
 
-	utils.Assert(len(key) == 0, "Empty key!")
-	utils.Assert(len(key) > BTREE_MAX_KEY_SIZE, "Key length greater than maximum!")
-	utils.Assert(len(val) > BTREE_MAX_VAL_SIZE, "Val length greater than maximum!")
+// an update of a key, with the outcome of it
+type UpdateReq struct {
+	Key  []byte
+	Val  []byte
+	Mode int
+	// out
+	Added   bool   // a new key was added
+	Updated bool   // a new key was added or the value of a key was changed
+	Old     []byte // the value before the update, nil if there was no key
+}
+
+// insert or replace a key depending on the mode.
+// returns whether the tree was changed, nothing is written
+// if the mode doesn't allow it or the value is the same.
+func (tree *BTree) Update(req *UpdateReq) (bool, error) {
+	return treeUpdate(tree, req, true)
+}
+
+// the insertion of Insert and Update, in one descent of the tree.
+// only Update reads the old value.
+func treeUpdate(tree *BTree, req *UpdateReq, keepOld bool) (bool, error) {
+	req.Added, req.Updated, req.Old = false, false, nil
+	if err := checkUpdate(req); err != nil {
+		return false, err
+	}
 
 	if tree.root == 0 { // inserting the first key
+		if req.Mode == MODE_UPDATE_ONLY {
+			return false, nil
+		}
+		val, ref, err := leafVal(tree, req.Val)
+		if err != nil {
+			return false, err
+		}
 		// create first leaf node as root
 		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 		root.setHeader(BNODE_LEAF, 2) // add dummy key = 2 so the tree covers key space
 		// lookup can always find a node containing a key
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
-		tree.root = tree.new(root)
-		return
+		nodeAppendKV(root, 1, 0, req.Key, val)
+		if ref {
+			root.setValRef(1)
+		}
+		ptr, err := tree.new(root)
+		if err != nil {
+			return false, err
+		}
+		tree.root = ptr
+		req.Added, req.Updated = true, true
+		return true, nil
+	}
+
+	node, err := tree.get(tree.root)
+	if err != nil {
+		return false, err
+	}
+	node, err = treeInsert(tree, node, req, keepOld)
+	if err != nil || node.data == nil {
+		return false, err
+	}
+	if err := tree.del(tree.root); err != nil {
+		return false, err
+	}
+	if err := treeSetRoot(tree, node); err != nil {
+		return false, err
 	}
+	return true, nil
+}
+
+// validate a request before updating the tree
+func checkUpdate(req *UpdateReq) error {
+	if req.Mode != MODE_UPSERT && req.Mode != MODE_UPDATE_ONLY && req.Mode != MODE_INSERT_ONLY {
+		return fmt.Errorf("%w: %d", ErrBadMode, req.Mode)
+	}
+	if err := checkKey(req.Key); err != nil {
+		return err
+	}
+	return checkVal(req.Val)
+}
 
-	node := tree.get(tree.root)
-	tree.del(tree.root)
-	node = treeInsert(tree, node, key, val)
+// allocate the updated root, the node might be bigger than 1 page
+func treeSetRoot(tree *BTree, node BNode) error {
 	nsplit, splitted := nodeSplit3(node)
 	if nsplit > 1 {
 		// if the root was split, add a new level and create a new root
 		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range splitted[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil) // add splitted nodes of old root to new root
+			ptr, err := tree.new(knode)
+			if err != nil {
+				return err
+			}
+			nodeAppendKV(root, uint16(i), ptr, knode.getKey(0), nil) // add splitted nodes of old root to new root
 		}
-		tree.root = tree.new(root) // reassign tree root to newly formed root
+		node = root
 	} else {
-		tree.root = tree.new(splitted[0])
+		node = splitted[0]
+	}
+	ptr, err := tree.new(node)
+	if err != nil {
+		return err
 	}
+	tree.root = ptr // reassign tree root to newly formed root
+	return nil
 }
@@ -0,0 +1,165 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/abedmohammed/goDB/utils"
+)
+
+// B-tree iterator, walks the leaves in key order.
+// the path from the root to the current leaf is kept so that
+// moving past the end of a leaf can step into its sibling.
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+	err  error    // the first error from reading a page
+}
+
+// move the position at `level` forward, returns false at the end of the tree
+func iterNext(iter *BIter, level int) (bool, error) {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level == 0 {
+		return false, nil // no sibling to move to
+	} else if ok, err := iterNext(iter, level-1); !ok || err != nil {
+		return false, err
+	}
+	if level+1 < len(iter.pos) {
+		// the position changed, load the kid node
+		node := iter.path[level]
+		kid, err := iter.tree.get(node.getPtr(iter.pos[level]))
+		if err != nil {
+			return false, err
+		}
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true, nil
+}
+
+// move the position at `level` backward, returns false at the start of the tree
+func iterPrev(iter *BIter, level int) (bool, error) {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level == 0 {
+		return false, nil // no sibling to move to
+	} else if ok, err := iterPrev(iter, level-1); !ok || err != nil {
+		return false, err
+	}
+	if level+1 < len(iter.pos) {
+		// the position changed, load the kid node
+		node := iter.path[level]
+		kid, err := iter.tree.get(node.getPtr(iter.pos[level]))
+		if err != nil {
+			return false, err
+		}
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true, nil
+}
+
+// move to the next key.
+// the iterator ends up past the last key when there is none.
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 || iter.err != nil {
+		return
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return // already past the last key
+	}
+	ok, err := iterNext(iter, last)
+	if err != nil {
+		iter.err = err
+	} else if !ok {
+		iter.pos[last] = iter.path[last].nkeys() // past the last key
+	}
+}
+
+// move to the previous key.
+// the iterator ends up on the dummy key when there is none.
+func (iter *BIter) Prev() {
+	if len(iter.path) == 0 || iter.err != nil {
+		return
+	}
+	_, iter.err = iterPrev(iter, len(iter.path)-1)
+}
+
+// is the iterator positioned at a real key?
+// it is not when past the last key, on the dummy first key or after an error.
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 || iter.err != nil {
+		return false // empty tree or bad page
+	}
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	if iter.pos[last] >= node.nkeys() {
+		return false
+	}
+	// the dummy key is the only empty key, see BTree.Insert
+	return len(node.getKey(iter.pos[last])) > 0
+}
+
+// get the current KV pair.
+// a value that can't be read from its overflow pages stops the iterator, see Err.
+func (iter *BIter) Deref() ([]byte, []byte) {
+	utils.Assert(!iter.Valid(), "Deref: Iterator out of range!")
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	val, err := leafGetVal(iter.tree, node, iter.pos[last])
+	if err != nil {
+		iter.err = err
+	}
+	return node.getKey(iter.pos[last]), val
+}
+
+// get the current key without reading the value
+func (iter *BIter) key() []byte {
+	utils.Assert(!iter.Valid(), "key: Iterator out of range!")
+	last := len(iter.path) - 1
+	return iter.path[last].getKey(iter.pos[last])
+}
+
+// the error that stopped the iterator, if any
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node, err := tree.get(ptr)
+		if err != nil {
+			iter.err = err
+			break
+		}
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		switch node.btype() {
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		case BNODE_LEAF:
+			ptr = 0 // reached the leaf
+		default:
+			iter.err = fmt.Errorf("%w: bad node type %d", ErrCorruptPage, node.btype())
+			return iter
+		}
+	}
+	return iter
+}
+
+// find the closest position that is greater or equal to the input key
+func (tree *BTree) SeekGE(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if !iter.Valid() {
+		iter.Next() // on the dummy key
+	} else if bytes.Compare(iter.key(), key) < 0 {
+		iter.Next()
+	}
+	return iter
+}
@@ -0,0 +1,58 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lock a database file against other processes with flock:
+// exclusive for a writer, shared for Options.ReadOnly.
+// the lock is on the file itself, and KV.Compact replaces the file,
+// so a lock taken on a file that has just been replaced is taken again.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	flags, how := os.O_RDONLY|os.O_CREATE, syscall.LOCK_EX
+	if !exclusive {
+		flags, how = os.O_RDONLY, syscall.LOCK_SH
+	}
+	for {
+		fp, err := os.OpenFile(path, flags, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open: %w", err)
+		}
+		err = syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			fp.Close()
+			return nil, ErrLocked
+		}
+		if err != nil {
+			fp.Close()
+			return nil, fmt.Errorf("flock: %w", err)
+		}
+		valid, err := lockValid(fp, path)
+		if valid {
+			return fp, nil
+		}
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// whether the locked file is still the one at the path
+func lockValid(fp *os.File, path string) (bool, error) {
+	locked, err := fp.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat: %w", err)
+	}
+	cur, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil // moved away
+	}
+	if err != nil {
+		return false, fmt.Errorf("stat: %w", err)
+	}
+	return os.SameFile(locked, cur), nil
+}
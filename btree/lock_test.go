@@ -0,0 +1,102 @@
+package btree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	for _, opts := range []Options{{}, {WAL: true}, {CacheSize: 1 << 16}, {Key: make([]byte, 16), WAL: true}} {
+		path := filepath.Join(t.TempDir(), "db")
+		ro := opts
+		ro.ReadOnly = true
+		if err := (&KV{Path: path, Options: ro}).Open(); err == nil {
+			t.Fatal("opened a missing file")
+		}
+		db := &KV{Path: path, Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set([]byte("a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range []Options{opts, ro} {
+			if err := (&KV{Path: path, Options: o}).Open(); !errors.Is(err, ErrLocked) {
+				t.Fatal("locked", err)
+			}
+		}
+		// the new file of a compaction is locked too
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&KV{Path: path, Options: opts}).Open(); !errors.Is(err, ErrLocked) {
+			t.Fatal("compacted", err)
+		}
+		if err := db.Set([]byte("b"), []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		// a crash leaves the log behind
+		cpath := path + ".crash"
+		copyFile(t, path, cpath)
+		if opts.WAL {
+			copyFile(t, path+".wal", cpath+".wal")
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// readers share the file and don't write to it
+		for _, p := range []string{path, cpath} {
+			before, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r1 := &KV{Path: p, Options: ro}
+			r2 := &KV{Path: p, Options: ro}
+			if err := r1.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r2.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := (&KV{Path: p, Options: opts}).Open(); !errors.Is(err, ErrLocked) {
+				t.Fatal("locked by readers", err)
+			}
+			for _, r := range []*KV{r1, r2} {
+				if v, ok, err := r.Get([]byte("b")); err != nil || !ok || string(v) != "2" {
+					t.Fatal("get", p, ok, err)
+				}
+				if err := r.Set([]byte("c"), nil); !errors.Is(err, ErrReadOnly) {
+					t.Fatal("set", err)
+				}
+				if _, err := r.Del([]byte("a")); !errors.Is(err, ErrReadOnly) {
+					t.Fatal("del", err)
+				}
+				if err := r.Compact(); !errors.Is(err, ErrReadOnly) {
+					t.Fatal("compact", err)
+				}
+				if res, err := r.Verify(); err != nil || !res.OK() {
+					t.Fatal(err, res.Errors)
+				}
+			}
+			r1.Close()
+			r2.Close()
+			after, err := os.Stat(p)
+			if err != nil || before.Size() != after.Size() || before.ModTime() != after.ModTime() {
+				t.Fatal("modified", p, err)
+			}
+			if fi, err := os.Stat(p + ".wal"); opts.WAL && p == cpath && (err != nil || fi.Size() == 0) {
+				t.Fatal("the log is replaced", err)
+			}
+		}
+		db = &KV{Path: path, Options: opts}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// values larger than BTREE_MAX_VAL_SIZE are spilled into a chain of overflow pages,
+// and the leaf only keeps a reference to the chain.
+//
+// the overflow page format.
+// | type | unused | next | data |
+// |  2B  |   2B   |  8B  | ...  |
+//
+// the reference format, flagged by VAL_REF in the vlen of the leaf KV.
+// | size | first page |
+// |  8B  |     8B     |
+const BNODE_OVERFLOW = 4
+const OVERFLOW_HEADER = 4 + 8
+const OVERFLOW_CAP = BTREE_NODE_SIZE - OVERFLOW_HEADER
+const VAL_REF = 1 << 15
+const VAL_REF_SIZE = 8 + 8
+
+// does the leaf KV at idx hold a reference to overflow pages?
+func (node BNode) isValRef(idx uint16) bool {
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node.data[pos+2:])&VAL_REF != 0
+}
+
+// flag the value of the KV at idx as a reference
+func (node BNode) setValRef(idx uint16) {
+	pos := node.kvPos(idx)
+	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+	binary.LittleEndian.PutUint16(node.data[pos+2:], vlen|VAL_REF)
+}
+
+// write the value into a chain of overflow pages, returns the reference
+func overflowWrite(tree *BTree, val []byte) ([]byte, error) {
+	// from the last page to the first, so each page knows its next page
+	next := uint64(0)
+	for end := len(val); end > 0; {
+		begin := (end - 1) / OVERFLOW_CAP * OVERFLOW_CAP
+		page := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		binary.LittleEndian.PutUint16(page.data[0:2], BNODE_OVERFLOW)
+		binary.LittleEndian.PutUint64(page.data[4:12], next)
+		copy(page.data[OVERFLOW_HEADER:], val[begin:end])
+		ptr, err := tree.new(page)
+		if err != nil {
+			return nil, err
+		}
+		next, end = ptr, begin
+	}
+	ref := make([]byte, VAL_REF_SIZE)
+	binary.LittleEndian.PutUint64(ref[0:8], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[8:16], next)
+	return ref, nil
+}
+
+// decode a reference
+func overflowRef(ref []byte) (size uint64, ptr uint64, err error) {
+	if len(ref) != VAL_REF_SIZE {
+		return 0, 0, fmt.Errorf("%w: bad overflow reference", ErrCorruptPage)
+	}
+	size = binary.LittleEndian.Uint64(ref[0:8])
+	ptr = binary.LittleEndian.Uint64(ref[8:16])
+	if size <= BTREE_MAX_VAL_SIZE || size > BTREE_MAX_BIG_VAL_SIZE {
+		return 0, 0, fmt.Errorf("%w: bad overflow value size %d", ErrCorruptPage, size)
+	}
+	return size, ptr, nil
+}
+
+// call fn on each page of the chain and the part of the value it holds.
+// each page holds up to `pageCap` bytes of the value.
+func overflowWalk(
+	tree *BTree, ref []byte, pageCap uint64, fn func(ptr uint64, data []byte) error,
+) error {
+	size, ptr, err := overflowRef(ref)
+	if err != nil {
+		return err
+	}
+	for ; size > 0; size -= min(size, pageCap) {
+		if ptr == 0 {
+			return fmt.Errorf("%w: unexpected end of overflow pages", ErrCorruptPage)
+		}
+		page, err := tree.get(ptr)
+		if err != nil {
+			return err
+		}
+		if page.btype() != BNODE_OVERFLOW {
+			return fmt.Errorf("%w: bad overflow page %d", ErrCorruptPage, ptr)
+		}
+		next := binary.LittleEndian.Uint64(page.data[4:12])
+		if err := fn(ptr, page.data[OVERFLOW_HEADER:][:min(size, pageCap)]); err != nil {
+			return err
+		}
+		ptr = next
+	}
+	return nil
+}
+
+// rebuild the value from the overflow pages
+func overflowRead(tree *BTree, ref []byte) ([]byte, error) {
+	return overflowReadCap(tree, ref, OVERFLOW_CAP)
+}
+
+func overflowReadCap(tree *BTree, ref []byte, pageCap uint64) ([]byte, error) {
+	size, _, err := overflowRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, 0, size)
+	err = overflowWalk(tree, ref, pageCap, func(_ uint64, data []byte) error {
+		val = append(val, data...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// deallocate the overflow pages of a value
+func overflowFree(tree *BTree, ref []byte) error {
+	return overflowWalk(tree, ref, OVERFLOW_CAP, func(ptr uint64, _ []byte) error {
+		return tree.del(ptr)
+	})
+}
+
+// the value of the leaf KV at idx, read from the overflow pages if needed
+func leafGetVal(tree *BTree, node BNode, idx uint16) ([]byte, error) {
+	if !node.isValRef(idx) {
+		return node.getVal(idx), nil
+	}
+	return overflowRead(tree, node.getVal(idx))
+}
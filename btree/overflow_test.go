@@ -0,0 +1,92 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// large values are spilled to chains that are freed with them
+func TestOverflow(t *testing.T) {
+	c := NewC()
+	r := rand.New(rand.NewSource(3))
+	ref := map[string][]byte{}
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("key%03d", r.Intn(200))
+		if r.Intn(4) == 0 {
+			if _, err := c.tree.Delete([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+			delete(ref, k)
+			continue
+		}
+		n := r.Intn(20000)
+		if r.Intn(5) == 0 {
+			n = OVERFLOW_CAP * (1 + r.Intn(3)) // chains of full pages
+		}
+		v := make([]byte, n)
+		r.Read(v)
+		if err := c.tree.Insert([]byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+		ref[k] = v
+	}
+	for k, v := range ref {
+		got, ok, err := c.tree.Get([]byte(k))
+		if err != nil || !ok || !bytes.Equal(got, v) {
+			t.Fatal("get", k, err, len(got), len(v))
+		}
+	}
+	for k := range ref {
+		if _, err := c.tree.Delete([]byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.pages) > 1 {
+		t.Fatal("leaked pages", len(c.pages))
+	}
+}
+
+func TestOverflowKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 10<<20)
+	rand.New(rand.NewSource(3)).Read(big)
+	for round := 0; round < 5; round++ {
+		if err := db.Set([]byte("big"), big[round:]); err != nil {
+			t.Fatal(err)
+		}
+		got, ok, err := db.Get([]byte("big"))
+		if err != nil || !ok || !bytes.Equal(got, big[round:]) {
+			t.Fatal("get", ok, err)
+		}
+		it := db.Scan(nil, nil)
+		if _, v := it.Deref(); !bytes.Equal(v, big[round:]) || it.Err() != nil {
+			t.Fatal("scan", it.Err())
+		}
+		it.Close()
+	}
+	// the chains of the old values are reused
+	if db.page.flushed > 3*uint64(len(big))/BTREE_PAGE_SIZE {
+		t.Fatal("the file keeps growing", db.page.flushed)
+	}
+	if _, err := db.Del([]byte("big")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok, _ := db.Get([]byte("big")); ok {
+		t.Fatal("deleted value")
+	}
+}
@@ -0,0 +1,238 @@
+package btree
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// the smallest pool that can hold a commit's worth of hot pages
+const POOL_MIN_PAGES = 16
+
+// a bounded cache of the pages of another store, usually a FileStore.
+// written pages are kept dirty until they are evicted or synced,
+// and the least recently used unpinned page is evicted first.
+// the budget counts the cached pages only: a page that was read stays valid
+// for its user after eviction, pages are replaced rather than updated.
+// the master page is written through, after the dirty pages it might refer to,
+// so the file never refers to pages that are only in the pool.
+// the KV reuses the pages that the master page on file doesn't refer to.
+type BufferPool struct {
+	store  PageStore // the backing store
+	budget int       // the maximum number of cached pages
+	mu     sync.Mutex
+	frames map[uint64]*poolFrame
+	lru    list.List // the unpinned frames, the most recently used first
+	pinned int       // the number of pinned frames, at most the budget
+	writes uint64    // the number of calls to Write
+}
+
+type poolFrame struct {
+	ptr   uint64
+	page  []byte
+	dirty bool          // not written to the store yet
+	pins  int           // pinned frames are not evicted
+	elem  *list.Element // the place in the LRU list, nil when pinned
+}
+
+// a pool of `budget` bytes on top of a store, which is closed with the pool
+func NewBufferPool(store PageStore, budget int) *BufferPool {
+	pool := &BufferPool{
+		store:  store,
+		budget: max(budget/BTREE_PAGE_SIZE, POOL_MIN_PAGES),
+		frames: map[uint64]*poolFrame{},
+	}
+	return pool
+}
+
+// open a file read with pread through a pool of `budget` bytes
+func OpenPoolStore(path string, budget int, readOnly bool) (*BufferPool, error) {
+	store, err := OpenFileStore(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return NewBufferPool(store, budget), nil
+}
+
+// the cached frame of a page, read from the store on a miss. called with mu held.
+func poolGet(pool *BufferPool, ptr uint64) (*poolFrame, error) {
+	if frame, ok := pool.frames[ptr]; ok {
+		if frame.elem != nil {
+			pool.lru.MoveToFront(frame.elem)
+		}
+		return frame, nil
+	}
+	// the read is done without the lock, so that hits aren't held up by it
+	for {
+		writes := pool.writes
+		pool.mu.Unlock()
+		page, err := pool.store.Read(ptr)
+		pool.mu.Lock()
+		if err != nil {
+			return nil, err
+		}
+		if frame, ok := pool.frames[ptr]; ok {
+			return frame, nil // cached meanwhile
+		}
+		if writes != pool.writes {
+			continue // the page might have been written and evicted meanwhile
+		}
+		frame := &poolFrame{ptr: ptr, page: page}
+		frame.elem = pool.lru.PushFront(frame)
+		pool.frames[ptr] = frame
+		return frame, poolEvict(pool)
+	}
+}
+
+// evict the least recently used pages over the budget. called with mu held.
+func poolEvict(pool *BufferPool) error {
+	for len(pool.frames) > pool.budget && pool.lru.Len() > 0 {
+		frame := pool.lru.Back().Value.(*poolFrame)
+		if frame.dirty {
+			if err := pool.store.Write(frame.ptr, frame.page); err != nil {
+				return err
+			}
+		}
+		pool.lru.Remove(frame.elem)
+		delete(pool.frames, frame.ptr)
+	}
+	return nil
+}
+
+func (pool *BufferPool) Read(ptr uint64) ([]byte, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	frame, err := poolGet(pool, ptr)
+	if err != nil {
+		return nil, err
+	}
+	return frame.page, nil
+}
+
+// keep a page in the pool until Unpin, whatever the budget.
+// it fails with ErrPoolFull if every frame of the budget is pinned.
+func (pool *BufferPool) Pin(ptr uint64) ([]byte, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if frame, ok := pool.frames[ptr]; !ok || frame.pins == 0 {
+		if pool.pinned >= pool.budget {
+			return nil, fmt.Errorf("%w: page %d", ErrPoolFull, ptr)
+		}
+	}
+	frame, err := poolGet(pool, ptr)
+	if err != nil {
+		return nil, err
+	}
+	if frame.pins == 0 {
+		if pool.pinned >= pool.budget {
+			return nil, fmt.Errorf("%w: page %d", ErrPoolFull, ptr) // pinned meanwhile
+		}
+		pool.pinned++
+		pool.lru.Remove(frame.elem)
+		frame.elem = nil
+	}
+	frame.pins++
+	return frame.page, nil
+}
+
+// undo a Pin, the page can be evicted once every Pin is undone
+func (pool *BufferPool) Unpin(ptr uint64) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	frame, ok := pool.frames[ptr]
+	if !ok || frame.pins == 0 {
+		return fmt.Errorf("BufferPool: page %d is not pinned", ptr)
+	}
+	if frame.pins--; frame.pins == 0 {
+		pool.pinned--
+		frame.elem = pool.lru.PushFront(frame)
+	}
+	return poolEvict(pool)
+}
+
+func (pool *BufferPool) Write(ptr uint64, page []byte) error {
+	if ptr >= pool.store.Size() {
+		return fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	data := append([]byte(nil), page[:BTREE_PAGE_SIZE]...)
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	dirty := true
+	if ptr == 0 {
+		// the master page goes to the store after the pages of its commit
+		if err := poolWriteBack(pool); err != nil {
+			return err
+		}
+		if err := pool.store.Write(0, data); err != nil {
+			return err
+		}
+		dirty = false
+	}
+	frame, ok := pool.frames[ptr]
+	if !ok {
+		frame = &poolFrame{ptr: ptr}
+		frame.elem = pool.lru.PushFront(frame)
+		pool.frames[ptr] = frame
+	} else if frame.elem != nil {
+		pool.lru.MoveToFront(frame.elem)
+	}
+	frame.page = data
+	frame.dirty = dirty
+	pool.writes++
+	return poolEvict(pool)
+}
+
+// write the dirty pages to the store
+func poolFlush(pool *BufferPool) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return poolWriteBack(pool)
+}
+
+// write the dirty pages in file order. called with mu held.
+func poolWriteBack(pool *BufferPool) error {
+	dirty := []*poolFrame{}
+	for _, frame := range pool.frames {
+		if frame.dirty {
+			dirty = append(dirty, frame)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].ptr < dirty[j].ptr })
+	for _, frame := range dirty {
+		if err := pool.store.Write(frame.ptr, frame.page); err != nil {
+			return err
+		}
+		frame.dirty = false
+	}
+	return nil
+}
+
+func (pool *BufferPool) Sync() error {
+	if err := poolFlush(pool); err != nil {
+		return err
+	}
+	return pool.store.Sync()
+}
+
+func (pool *BufferPool) Size() uint64 {
+	return pool.store.Size()
+}
+
+func (pool *BufferPool) Grow(npages uint64) error {
+	return pool.store.Grow(npages)
+}
+
+// write the dirty pages and close the store
+func (pool *BufferPool) Close() error {
+	err := poolFlush(pool)
+	pool.mu.Lock()
+	pool.frames = map[uint64]*poolFrame{}
+	pool.lru.Init()
+	pool.pinned = 0
+	pool.mu.Unlock()
+	if e := pool.store.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+// a store that records the order of the writes
+type writeLog struct {
+	PageStore
+	writes []uint64
+}
+
+func (store *writeLog) Write(ptr uint64, page []byte) error {
+	store.writes = append(store.writes, ptr)
+	return store.PageStore.Write(ptr, page)
+}
+
+func TestPoolMasterWriteThrough(t *testing.T) {
+	log := &writeLog{PageStore: NewMemStore()}
+	if err := log.Grow(4 * POOL_MIN_PAGES); err != nil {
+		t.Fatal(err)
+	}
+	pool := NewBufferPool(log, 0)
+	page := make([]byte, BTREE_PAGE_SIZE)
+	for _, ptr := range []uint64{5, 3, 0, 7} {
+		if err := pool.Write(ptr, page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the pages written before the master page go first
+	if !slices.Equal(log.writes, []uint64{3, 5, 0}) {
+		t.Fatal("bad write order", log.writes)
+	}
+	// the rest are written on eviction
+	for ptr := uint64(8); ptr < 8+2*POOL_MIN_PAGES; ptr++ {
+		if err := pool.Write(ptr, page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(pool.frames) > pool.budget {
+		t.Fatal("over budget", len(pool.frames))
+	}
+	if slices.Contains(log.writes[3:], 0) || !slices.Contains(log.writes, 7) {
+		t.Fatal("bad evictions", log.writes)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a pool smaller than the database, with readers and compaction
+func TestPool(t *testing.T) {
+	for _, mode := range []SyncMode{SyncFull, SyncNormal, SyncOff} {
+		path := filepath.Join(t.TempDir(), "db")
+		db := &KV{Path: path, Options: Options{CacheSize: 64 * BTREE_PAGE_SIZE, Sync: mode}}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		var stop atomic.Bool
+		done := make(chan struct{})
+		for i := 0; i < 3; i++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				for !stop.Load() {
+					it := db.Scan(nil, nil)
+					for ; it.Valid(); it.Next() {
+						it.Deref()
+					}
+					if it.Err() != nil {
+						t.Error(it.Err())
+					}
+					it.Close()
+				}
+			}()
+		}
+		ref := map[string]string{}
+		r := rand.New(rand.NewSource(7))
+		for i := 0; i < 3000; i++ {
+			k := fmt.Sprintf("k%05d", r.Intn(1000))
+			v := string(bytes.Repeat([]byte{'v'}, r.Intn(5000)))
+			if r.Intn(3) == 0 {
+				delete(ref, k)
+				if _, err := db.Del([]byte(k)); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				ref[k] = v
+				if err := db.Set([]byte(k), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		stop.Store(true)
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+		kvCheck(t, db, ref)
+		pool := db.store.(*BufferPool)
+		if len(pool.frames) > pool.budget {
+			t.Fatal("over budget", len(pool.frames))
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = &KV{Path: path}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		kvCheck(t, db, ref)
+		res, err := db.Verify()
+		if err != nil || !res.OK() {
+			t.Fatal(err, res.Errors)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a pinned page stays in the pool whatever else is read and written
+func TestPoolPin(t *testing.T) {
+	log := &writeLog{PageStore: NewMemStore()}
+	if err := log.Grow(4 * POOL_MIN_PAGES); err != nil {
+		t.Fatal(err)
+	}
+	pool := NewBufferPool(log, 0)
+	page := make([]byte, BTREE_PAGE_SIZE)
+	page[0] = 1
+	if err := pool.Write(1, page); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Pin(1); err != nil {
+		t.Fatal(err)
+	}
+	for ptr := uint64(2); ptr < 4*POOL_MIN_PAGES; ptr++ {
+		if err := pool.Write(ptr, page); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.Read(ptr - 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frame, ok := pool.frames[1]; !ok || !frame.dirty || slices.Contains(log.writes, 1) {
+		t.Fatal("the pinned page is evicted")
+	}
+	if len(pool.frames) > pool.budget {
+		t.Fatal("over budget", len(pool.frames))
+	}
+	// pin every frame, pages can still be read but not pinned
+	for ptr := uint64(2); ptr <= uint64(pool.budget); ptr++ {
+		if _, err := pool.Pin(ptr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pool.Pin(1); err != nil {
+		t.Fatal("pin a pinned page", err)
+	}
+	if _, err := pool.Pin(40); !errors.Is(err, ErrPoolFull) {
+		t.Fatal("every frame is pinned", err)
+	}
+	if got, err := pool.Read(40); err != nil || got[0] != 1 {
+		t.Fatal("read", err)
+	}
+	// the page is evicted once every Pin is undone
+	for i := 0; i < 2; i++ {
+		if err := pool.Unpin(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.Unpin(1); err == nil {
+		t.Fatal("unpin an unpinned page")
+	}
+	if _, err := pool.Pin(40); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.frames[1]; ok || !slices.Contains(log.writes, 1) {
+		t.Fatal("the unpinned page is not evicted")
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,354 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/abedmohammed/goDB/utils"
+)
+
+// the storage of the database pages, addressed by page number.
+// a KV has a single writer, but readers call Read and Size concurrently with it.
+type PageStore interface {
+	// the page at ptr, which must be below Size.
+	// the result must not be modified, and stays valid until the store is closed.
+	Read(ptr uint64) ([]byte, error)
+	// replace the page at ptr, which must be below Size.
+	// `page` is BTREE_PAGE_SIZE bytes and isn't used after the call.
+	Write(ptr uint64, page []byte) error
+	// make the written pages durable
+	Sync() error
+	// the number of pages, including the ones beyond the database
+	Size() uint64
+	// make room for at least `npages` pages
+	Grow(npages uint64) error
+	Close() error
+}
+
+// open the file store used by default
+func openStore(db *KV, path string) (PageStore, error) {
+	readOnly := db.Options.ReadOnly
+	if db.Options.Store != nil {
+		return db.Options.Store(path)
+	}
+	if db.Options.Key != nil {
+		store, err := OpenCryptStore(path, db.Options.Key, readOnly)
+		if err != nil || db.Options.CacheSize <= 0 {
+			return store, err
+		}
+		return NewBufferPool(store, db.Options.CacheSize), nil
+	}
+	if db.Options.CacheSize > 0 {
+		return OpenPoolStore(path, db.Options.CacheSize, readOnly)
+	}
+	return OpenMmapStore(path, readOnly)
+}
+
+// the number of pages to grow a file to, to fit `npages`.
+// the file size is increased exponentially,
+// so that we don't have to extend the file for every update.
+func growPages(filePages uint64, npages uint64) uint64 {
+	for filePages < npages {
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+	return filePages
+}
+
+// open or create a database file of `slotSize` bytes per page, and check its size.
+// a read-only file must exist.
+func openPageFile(path string, slotSize int64, readOnly bool) (*os.File, uint64, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("OpenFile: %w", err)
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size()%slotSize != 0 {
+		fp.Close()
+		return nil, 0, errors.New("File size is not a multiple of page size.")
+	}
+	return fp, uint64(fi.Size() / slotSize), nil
+}
+
+// extend the file to `npages`
+func fallocatePages(fp *os.File, npages uint64, slotSize int64) error {
+	err := syscall.Fallocate(int(fp.Fd()), 0, 0, int64(npages)*slotSize)
+	if err != nil {
+		return fmt.Errorf("fallocate: %w", err)
+	}
+	return nil
+}
+
+// a file that is read through mmaps and written with pwrite
+type MmapStore struct {
+	fp       *os.File
+	readOnly bool         // mapped with PROT_READ, Write and Grow fail
+	mu       sync.RWMutex // protects the fields below from the readers
+	// file size in pages, can be larger than the database size
+	file uint64
+	// mmap size, can be larger than the file size
+	total int
+	// multiple mmaps, can be non-continuous
+	chunks [][]byte
+}
+
+// open or create a file and create the initial mmap that covers it
+func OpenMmapStore(path string, readOnly bool) (*MmapStore, error) {
+	fp, npages, err := openPageFile(path, BTREE_PAGE_SIZE, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	mmapSize := 64 << 20
+	utils.Assert(mmapSize%BTREE_PAGE_SIZE != 0, "OpenMmapStore: Mmap size is not a multiple of page size!")
+	for mmapSize < int(npages*BTREE_PAGE_SIZE) {
+		mmapSize *= 2
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	if readOnly {
+		prot = syscall.PROT_READ
+	}
+	// mmapSize can be larger than the file
+	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, prot, syscall.MAP_SHARED)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	store := &MmapStore{fp: fp, readOnly: readOnly, file: npages, total: mmapSize}
+	store.chunks = [][]byte{chunk}
+	return store, nil
+}
+
+func (store *MmapStore) Read(ptr uint64) ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if ptr >= store.file {
+		return nil, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	// locate the page in the mmaps
+	start := uint64(0)
+	for _, chunk := range store.chunks {
+		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+		if ptr < end {
+			offset := BTREE_PAGE_SIZE * (ptr - start)
+			return chunk[offset : offset+BTREE_PAGE_SIZE], nil
+		}
+		start = end
+	}
+	return nil, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+}
+
+// NOTE: Updating a page via mmap is not atomic, a master page slot
+// could be flushed halfway. Use the `pwrite()` syscall instead.
+func (store *MmapStore) Write(ptr uint64, page []byte) error {
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if ptr >= store.Size() {
+		return fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	if _, err := store.fp.WriteAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return fmt.Errorf("write page %d: %w", ptr, err)
+	}
+	return nil
+}
+
+func (store *MmapStore) Sync() error {
+	return store.fp.Sync()
+}
+
+func (store *MmapStore) Size() uint64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.file
+}
+
+func (store *MmapStore) Grow(npages uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file >= npages {
+		return nil
+	}
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	filePages := growPages(store.file, npages)
+	if err := fallocatePages(store.fp, filePages, BTREE_PAGE_SIZE); err != nil {
+		return err
+	}
+	store.file = filePages
+	for store.total < int(filePages*BTREE_PAGE_SIZE) {
+		// double the address space
+		chunk, err := syscall.Mmap(
+			int(store.fp.Fd()), int64(store.total), store.total,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		store.total += store.total
+		store.chunks = append(store.chunks, chunk)
+	}
+	return nil
+}
+
+func (store *MmapStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var err error
+	for _, chunk := range store.chunks {
+		if e := syscall.Munmap(chunk); e != nil && err == nil {
+			err = fmt.Errorf("munmap: %w", e)
+		}
+	}
+	store.chunks = nil
+	store.file = 0
+	if e := store.fp.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// a file that is read and written with pread and pwrite,
+// for filesystems where mmap doesn't work well
+type FileStore struct {
+	fp       *os.File
+	readOnly bool          // Write and Grow fail
+	file     atomic.Uint64 // file size in pages
+}
+
+// open or create a file
+func OpenFileStore(path string, readOnly bool) (*FileStore, error) {
+	fp, npages, err := openPageFile(path, BTREE_PAGE_SIZE, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileStore{fp: fp, readOnly: readOnly}
+	store.file.Store(npages)
+	return store, nil
+}
+
+func (store *FileStore) Read(ptr uint64) ([]byte, error) {
+	if ptr >= store.file.Load() {
+		return nil, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	page := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := store.fp.ReadAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return nil, fmt.Errorf("read page %d: %w", ptr, err)
+	}
+	return page, nil
+}
+
+func (store *FileStore) Write(ptr uint64, page []byte) error {
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	if ptr >= store.file.Load() {
+		return fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	if _, err := store.fp.WriteAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return fmt.Errorf("write page %d: %w", ptr, err)
+	}
+	return nil
+}
+
+func (store *FileStore) Sync() error {
+	return store.fp.Sync()
+}
+
+func (store *FileStore) Size() uint64 {
+	return store.file.Load()
+}
+
+func (store *FileStore) Grow(npages uint64) error {
+	if store.file.Load() >= npages {
+		return nil
+	}
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	filePages := growPages(store.file.Load(), npages)
+	if err := fallocatePages(store.fp, filePages, BTREE_PAGE_SIZE); err != nil {
+		return err
+	}
+	store.file.Store(filePages)
+	return nil
+}
+
+func (store *FileStore) Close() error {
+	store.file.Store(0)
+	return store.fp.Close()
+}
+
+// pages kept in memory, nothing is persisted
+type MemStore struct {
+	mu    sync.RWMutex
+	pages [][]byte // nil for a page that was never written
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+func (store *MemStore) Read(ptr uint64) ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if ptr >= uint64(len(store.pages)) {
+		return nil, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	if store.pages[ptr] == nil {
+		return make([]byte, BTREE_PAGE_SIZE), nil
+	}
+	return store.pages[ptr], nil
+}
+
+// the page is replaced rather than updated, so the results of Read don't change
+func (store *MemStore) Write(ptr uint64, page []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if ptr >= uint64(len(store.pages)) {
+		return fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	store.pages[ptr] = append([]byte(nil), page[:BTREE_PAGE_SIZE]...)
+	return nil
+}
+
+func (store *MemStore) Sync() error {
+	return nil
+}
+
+func (store *MemStore) Size() uint64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return uint64(len(store.pages))
+}
+
+func (store *MemStore) Grow(npages uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for uint64(len(store.pages)) < npages {
+		store.pages = append(store.pages, nil)
+	}
+	return nil
+}
+
+func (store *MemStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.pages = nil
+	return nil
+}
@@ -0,0 +1,75 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(string) (PageStore, error){
+		"file": func(path string) (PageStore, error) { return OpenFileStore(path, false) },
+		"mem":  func(string) (PageStore, error) { return NewMemStore(), nil },
+		"mmap": nil,
+	}
+	for name, open := range stores {
+		for _, wal := range []bool{false, true} {
+			path := filepath.Join(t.TempDir(), "db")
+			db := &KV{Path: path, Options: Options{Store: open, WAL: wal}}
+			if err := db.Open(); err != nil {
+				t.Fatal(name, err)
+			}
+			ref := map[string]string{}
+			r := rand.New(rand.NewSource(5))
+			for i := 0; i < 3000; i++ {
+				k := fmt.Sprintf("k%05d", r.Intn(1000))
+				v := string(bytes.Repeat([]byte{'v'}, r.Intn(5000)))
+				if r.Intn(3) == 0 {
+					delete(ref, k)
+					if _, err := db.Del([]byte(k)); err != nil {
+						t.Fatal(name, err)
+					}
+				} else {
+					ref[k] = v
+					if err := db.Set([]byte(k), []byte(v)); err != nil {
+						t.Fatal(name, err)
+					}
+				}
+			}
+			kvCheck(t, db, ref)
+			// a compaction switches to a new store of the same kind
+			reader, err := db.BeginRead()
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if err := db.Compact(); err != nil {
+				t.Fatal(name, err)
+			}
+			if _, _, err := reader.Get([]byte("k00001")); err != nil {
+				t.Fatal(name, err)
+			}
+			reader.EndRead()
+			kvCheck(t, db, ref)
+			res, err := db.Verify()
+			if err != nil || !res.OK() {
+				t.Fatal(name, err, res.Errors)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(name, err)
+			}
+			if name == "mem" {
+				continue // nothing persists
+			}
+			db = &KV{Path: path, Options: Options{Store: open}}
+			if err := db.Open(); err != nil {
+				t.Fatal(name, err)
+			}
+			kvCheck(t, db, ref)
+			if err := db.Close(); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package btree
+
+import "fmt"
+
+// group commit.
+// a commit writes its pages while holding the writer lock, then releases it
+// and waits in kvSync for the fsyncs. one of the waiting committers does them
+// for every commit written so far, so concurrent commits share the fsyncs.
+// readers can see a commit before it's durable.
+
+// hand a written commit over to the fsyncs. called with the writer lock held.
+func kvWritten(db *KV, version uint64) {
+	db.sync.mu.Lock()
+	defer db.sync.mu.Unlock()
+	db.sync.written = version
+	db.sync.master = masterCurrent(db)
+}
+
+// everything up to `version` is durable without fsyncs,
+// after opening a file or taking over a compacted one.
+func kvSynced(db *KV, version uint64) {
+	db.sync.mu.Lock()
+	defer db.sync.mu.Unlock()
+	db.sync.written = version
+	db.sync.master = masterCurrent(db)
+	db.sync.synced = version
+	db.sync.durable = version
+	db.sync.saved = version
+}
+
+// wait until `version` is durable, doing the fsyncs if no one else is
+func kvSync(db *KV, version uint64) error {
+	s := &db.sync
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.synced < version && s.err == nil {
+		if s.running {
+			s.cond.Wait() // the fsyncs in progress may not cover this version
+			continue
+		}
+		// sync everything written so far
+		s.running = true
+		target, master := s.written, s.master
+		s.mu.Unlock()
+		durable, err := syncPages(db, target, master)
+		s.mu.Lock()
+		s.running = false
+		if err != nil {
+			s.err = err
+		} else {
+			s.synced, s.durable = target, durable
+		}
+		s.cond.Broadcast()
+	}
+	if s.synced < version {
+		return s.err
+	}
+	return nil
+}
+
+// wait for all written commits. called with the writer lock held.
+func kvSyncAll(db *KV) error {
+	db.sync.mu.Lock()
+	written := db.sync.written
+	db.sync.mu.Unlock()
+	return kvSync(db, written)
+}
+
+// the last version whose master page is durable.
+// the pages it uses must stay intact, a crash can go back to it.
+func kvDurable(db *KV) uint64 {
+	db.sync.mu.Lock()
+	defer db.sync.mu.Unlock()
+	return db.sync.durable
+}
+
+// the failed fsync that stops further commits
+func kvSyncErr(db *KV) error {
+	db.sync.mu.Lock()
+	defer db.sync.mu.Unlock()
+	if db.sync.err != nil {
+		return fmt.Errorf("an earlier commit failed: %w", db.sync.err)
+	}
+	return nil
+}
+
+// make the commits up to `version` durable as the SyncMode says.
+// called by one committer at a time, without the writer lock.
+// returns the last version whose master page is durable.
+func syncPages(db *KV, version uint64, master masterSlot) (uint64, error) {
+	mode := db.Options.Sync
+	if db.Options.WAL {
+		// the main file is only written by checkpoints
+		if mode == SyncFull {
+			if err := db.wal.fp.Sync(); err != nil {
+				return 0, fmt.Errorf("fsync WAL: %w", err)
+			}
+		}
+		return version, nil
+	}
+	if mode == SyncOff {
+		return version, masterStore(db, master)
+	}
+	// flush data to the disk. must be done before updating the master page.
+	if err := db.store.Sync(); err != nil {
+		return 0, fmt.Errorf("fsync: %w", err)
+	}
+	durable := db.sync.saved // went to the disk with the pages
+	if err := masterStore(db, master); err != nil {
+		return 0, err
+	}
+	db.sync.saved = version
+	if mode == SyncNormal {
+		return durable, nil // the master page goes with the next fsync
+	}
+	if err := db.store.Sync(); err != nil {
+		return 0, fmt.Errorf("fsync: %w", err)
+	}
+	return version, nil
+}
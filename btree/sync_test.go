@@ -0,0 +1,68 @@
+package btree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// concurrent commits in every sync mode, and the files a crash would leave
+func TestSyncModes(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		for _, mode := range []SyncMode{SyncFull, SyncNormal, SyncOff} {
+			path := filepath.Join(t.TempDir(), "db")
+			db := &KV{Path: path, Options: Options{WAL: wal, Sync: mode}}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						k := fmt.Sprintf("g%d-%d", g, i)
+						if err := db.Set([]byte(k), []byte(k)); err != nil {
+							t.Error(err)
+							return
+						}
+						if i%3 == 0 {
+							if _, err := db.Del([]byte(fmt.Sprintf("g%d-%d", g, i/2))); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			res, err := db.Verify()
+			if err != nil || !res.OK() {
+				t.Fatal(wal, mode, err, res.Errors)
+			}
+			keys := res.Keys
+			cpath := path + ".crash"
+			copyFile(t, path, cpath)
+			if wal {
+				copyFile(t, path+".wal", cpath+".wal")
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{path, cpath} {
+				db = &KV{Path: p}
+				if err := db.Open(); err != nil {
+					t.Fatal(wal, mode, err)
+				}
+				res, err := db.Verify()
+				if err != nil || !res.OK() || res.Keys != keys {
+					t.Fatal(wal, mode, p, err, res.Errors, res.Keys, keys)
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
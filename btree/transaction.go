@@ -0,0 +1,240 @@
+package btree
+
+import "fmt"
+
+// KV transaction.
+// updates are kept in memory until Commit writes them all at once,
+// and reads through the transaction see its own updates.
+// only one transaction can be in progress at a time,
+// Begin waits for the previous one to end.
+type KVTX struct {
+	db    *KV
+	saved kvMaster // the state to restore on Abort
+	err   error    // an update failed halfway, the tx can only be aborted
+	done  bool
+}
+
+// begin a transaction
+func (db *KV) Begin() (*KVTX, error) {
+	db.writer.Lock()
+	if db.store == nil {
+		db.writer.Unlock()
+		return nil, ErrClosed
+	}
+	if db.Options.ReadOnly {
+		db.writer.Unlock()
+		return nil, ErrReadOnly
+	}
+	if err := kvSyncErr(db); err != nil {
+		db.writer.Unlock()
+		return nil, err
+	}
+	// pages freed after the oldest reader's version can't be reused yet,
+	// nor the ones that a crash can go back to
+	db.free.SetMaxSeq(min(kvOldestVersion(db), kvDurable(db)))
+	return &KVTX{db: db, saved: masterSave(db)}, nil
+}
+
+// end a transaction: write all pages and update the master page once.
+// the next transaction can begin while this one waits for the fsyncs.
+func (tx *KVTX) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.err != nil {
+		tx.Abort()
+		return tx.err
+	}
+	tx.done = true
+	db := tx.db
+	unchanged := db.tree.root == tx.saved.root && db.catalog.root == tx.saved.catalog
+	if unchanged && len(db.page.updates) == 0 {
+		db.writer.Unlock()
+		return nil // nothing to write
+	}
+	if err := flushPages(db); err != nil {
+		masterRevert(db, tx.saved)
+		db.writer.Unlock()
+		return err
+	}
+	// new readers see this version from now on
+	version := kvPublish(db)
+	db.free.Commit(version)
+	kvWritten(db, version)
+	db.writer.Unlock()
+	return kvSync(db, version)
+}
+
+// end a transaction: discard the updates and go back to the old root and free list
+func (tx *KVTX) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	masterRevert(tx.db, tx.saved)
+	tx.db.writer.Unlock()
+}
+
+// check that the tx can still be used
+func txCheck(tx *KVTX) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.err
+}
+
+// read the db, including the updates of this tx
+func (tx *KVTX) Get(key []byte) ([]byte, bool, error) {
+	if err := txCheck(tx); err != nil {
+		return nil, false, err
+	}
+	return tx.db.tree.Get(key)
+}
+
+// iterate over the keys in [start, end), including the updates of this tx
+func (tx *KVTX) Scan(start []byte, end []byte) *KVIter {
+	if err := txCheck(tx); err != nil {
+		return &KVIter{iter: &BIter{err: err}}
+	}
+	return &KVIter{iter: tx.db.tree.SeekGE(start), end: end}
+}
+
+// update the db
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	if err := txCheck(tx); err != nil {
+		return err
+	}
+	// bad input is rejected before anything is changed
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := checkVal(val); err != nil {
+		return err
+	}
+	if err := tx.db.tree.Insert(key, val); err != nil {
+		tx.err = err
+		return err
+	}
+	return nil
+}
+
+// update the db depending on the mode of the request, see BTree.Update
+func (tx *KVTX) Update(req *UpdateReq) (bool, error) {
+	if err := txCheck(tx); err != nil {
+		return false, err
+	}
+	// bad input is rejected before anything is changed
+	if err := checkUpdate(req); err != nil {
+		return false, err
+	}
+	updated, err := tx.db.tree.Update(req)
+	if err != nil {
+		tx.err = err
+		return false, err
+	}
+	return updated, nil
+}
+
+func (tx *KVTX) Del(key []byte) (bool, error) {
+	if err := txCheck(tx); err != nil {
+		return false, err
+	}
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	deleted, err := tx.db.tree.Delete(key)
+	if err != nil {
+		tx.err = err
+		return false, err
+	}
+	return deleted, nil
+}
+
+// read-only snapshot of the last committed version.
+// any number of readers can run alongside each other and the write transaction,
+// the pages of the version are not reused until EndRead.
+type KVReader struct {
+	db      *KV
+	version uint64
+	tree    BTree
+	catalog BTree             // the buckets of the version
+	master  masterSlot        // the master page of the version
+	store   PageStore         // the file of the version
+	wal     map[uint64][]byte // the pages of the version that are only in the log
+	done    bool
+}
+
+// begin a read-only snapshot
+func (db *KV) BeginRead() (*KVReader, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.commit.store == nil {
+		return nil, ErrClosed
+	}
+	reader := &KVReader{
+		db:      db,
+		version: db.commit.version,
+		master:  db.commit.master,
+		store:   db.commit.store,
+		wal:     db.commit.wal,
+	}
+	reader.tree.root = db.commit.master.root
+	reader.tree.get = reader.pageGet
+	reader.catalog.root = db.commit.master.catalog
+	reader.catalog.get = reader.pageGet
+	db.readers[reader.version]++
+	return reader, nil
+}
+
+// end a read-only snapshot, the keys and values read from it are not valid after that
+func (reader *KVReader) EndRead() {
+	if reader.done {
+		return
+	}
+	reader.done = true
+	db := reader.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.readers[reader.version]--; db.readers[reader.version] == 0 {
+		delete(db.readers, reader.version)
+	}
+	kvRelease(db) // the old file might be done after a compaction
+}
+
+// callback for the snapshot BTree, dereference a pointer
+func (reader *KVReader) pageGet(ptr uint64) (BNode, error) {
+	if ptr == 0 || ptr >= reader.master.used {
+		return BNode{}, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+	}
+	if page, ok := walLookup(reader.db, reader.wal, ptr); ok {
+		return pageDecode(page, ptr)
+	}
+	return pageRead(reader.store, ptr)
+}
+
+// the oldest version that is still being read, or the latest version
+func kvOldestVersion(db *KV) uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	oldest := db.commit.version
+	for version := range db.readers {
+		oldest = min(oldest, version)
+	}
+	return oldest
+}
+
+// read the snapshot
+func (reader *KVReader) Get(key []byte) ([]byte, bool, error) {
+	if reader.done {
+		return nil, false, ErrTxDone
+	}
+	return reader.tree.Get(key)
+}
+
+// iterate over the keys in [start, end) of the snapshot
+func (reader *KVReader) Scan(start []byte, end []byte) *KVIter {
+	if reader.done {
+		return &KVIter{iter: &BIter{err: ErrTxDone}}
+	}
+	return &KVIter{iter: reader.tree.SeekGE(start), end: end}
+}
@@ -0,0 +1,158 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// a transaction reads its own updates, an aborted one leaves nothing
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Del([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := tx.Get([]byte("a")); ok {
+		t.Fatal("deleted key")
+	}
+	if v, ok, _ := tx.Get([]byte("k0500")); !ok || len(v) != 200 {
+		t.Fatal("set key")
+	}
+	tx.Abort()
+	if v, ok, _ := db.Get([]byte("a")); !ok || string(v) != "1" {
+		t.Fatal("aborted delete")
+	}
+	if _, ok, _ := db.Get([]byte("k0500")); ok {
+		t.Fatal("aborted set")
+	}
+	if err := tx.Set([]byte("x"), nil); !errors.Is(err, ErrTxDone) {
+		t.Fatal("aborted tx", err)
+	}
+
+	// a bad update doesn't end the transaction
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Set(nil, nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatal("empty key", err)
+	}
+	n := 0
+	for it := tx.Scan([]byte("k"), []byte("l")); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 1000 {
+		t.Fatal("scan count", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok, _ := db.Get([]byte("k0999")); !ok {
+		t.Fatal("committed set")
+	}
+}
+
+// readers see whole commits while the writer updates every key
+func TestReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	const N = 300
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				reader, err := db.BeginRead()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var want []byte
+				n := 0
+				it := reader.Scan([]byte("k"), nil)
+				for ; it.Valid(); it.Next() {
+					_, v := it.Deref()
+					if want == nil {
+						want = bytes.Clone(v)
+					} else if !bytes.Equal(v, want) {
+						t.Errorf("mixed commits %q %q", v[:8], want[:8])
+						break
+					}
+					n++
+				}
+				if it.Err() != nil {
+					t.Error(it.Err())
+				}
+				if n != 0 && n != N {
+					t.Error("scan count", n)
+				}
+				reader.EndRead()
+			}
+		}()
+	}
+	for round := 0; round < 200; round++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := bytes.Repeat([]byte(fmt.Sprintf("%08d", round)), 1+round%50)
+		for i := 0; i < N; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("k%05d", i)), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round%7 == 3 {
+			tx.Abort()
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	if v, ok, err := db.Get([]byte("k00001")); err != nil || !ok || !bytes.HasPrefix(v, []byte("00000198")) {
+		t.Fatal("last commit", ok, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
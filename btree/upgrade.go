@@ -0,0 +1,91 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// the overflow page capacity of the old format, whose pages have no trailer
+const V08_OVERFLOW_CAP = BTREE_PAGE_SIZE - OVERFLOW_HEADER
+
+// rewrite a database file of the format before page checksums (DB_SIG_V08)
+// into the current format. the database must not be open, it's locked meanwhile.
+// the KVs are copied to a new file that replaces the old one once it's complete,
+// so the old file is left as it was if anything fails.
+func Upgrade(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	defer fp.Close()
+	lock, err := lockFile(path, true)
+	if err != nil {
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	defer lock.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("Upgrade: stat: %w", err)
+	}
+	if fi.Size()%BTREE_PAGE_SIZE != 0 {
+		return errors.New("Upgrade: File size is not a multiple of page size.")
+	}
+	npages := uint64(fi.Size() / BTREE_PAGE_SIZE)
+	if npages == 0 {
+		return nil // empty file, nothing to convert
+	}
+	master := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := fp.ReadAt(master, 0); err != nil {
+		return fmt.Errorf("Upgrade: read master page: %w", err)
+	}
+	slot, _, err := masterPick(master, DB_SIG_V08, npages)
+	if err != nil {
+		if _, _, e := masterPick(master, DB_SIG, npages); e == nil {
+			return nil // already in the current format
+		}
+		if _, _, e := masterPick(master, DB_SIG_V09, npages); e == nil {
+			return nil // KV.Open converts it
+		}
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	// the old pages are read as they are
+	old := &BTree{root: slot.root}
+	old.get = func(ptr uint64) (BNode, error) {
+		if ptr == 0 || ptr >= slot.used {
+			return BNode{}, fmt.Errorf("%w: bad pointer %d", ErrCorruptPage, ptr)
+		}
+		page := make([]byte, BTREE_PAGE_SIZE)
+		if _, err := fp.ReadAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+			return BNode{}, fmt.Errorf("read page %d: %w", ptr, err)
+		}
+		return BNode{page}, nil
+	}
+
+	// the new file goes next to the old one, with a name of its own
+	tmpfp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp.*")
+	if err != nil {
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	tmp := tmpfp.Name()
+	tmpfp.Close()
+	db := &KV{Path: tmp}
+	if err := db.Open(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	err = treeCopy(old, db, V08_OVERFLOW_CAP, nil)
+	if e := db.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Upgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// write a master slot in the format of an older signature
+func masterOld(page []byte, off int, sig string, slot masterSlot) {
+	data := page[off:]
+	copy(data, sig)
+	binary.LittleEndian.PutUint64(data[16:], slot.txid)
+	binary.LittleEndian.PutUint64(data[24:], slot.root)
+	binary.LittleEndian.PutUint64(data[32:], slot.used)
+	binary.LittleEndian.PutUint64(data[40:], slot.free.headPage)
+	binary.LittleEndian.PutUint64(data[48:], slot.free.headSeq)
+	binary.LittleEndian.PutUint64(data[56:], slot.free.tailPage)
+	binary.LittleEndian.PutUint64(data[64:], slot.free.tailSeq)
+	size := MASTER_SLOT_SIZE_V09
+	binary.LittleEndian.PutUint32(data[size-4:], crc32.Checksum(data[:size-4], crcTable))
+	clear(data[size:MASTER_SLOT_SIZE])
+}
+
+// rewrite the master page of a closed file in an older format
+func masterRewrite(t *testing.T, path string, sig string, slot masterSlot) {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	masterOld(page, 0, sig, slot)
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if _, err := fp.WriteAt(page, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// flip a byte of a page of a closed file
+func pageFlip(t *testing.T, path string, ptr uint64) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	b := []byte{0}
+	off := int64(ptr)*BTREE_PAGE_SIZE + 100
+	if _, err := fp.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte{b[0] ^ 0x55}, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := db.tree.root
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pageFlip(t, path, root)
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, _, err := db.Get([]byte("k00001")); !errors.Is(err, ErrCorruptPage) {
+		t.Fatal("flipped page", err)
+	}
+}
+
+// a file of the format before page checksums is converted by Upgrade
+func TestUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// the nodes are the same in both formats, without the trailer
+	ref := map[string]string{}
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("k%05d", i)
+		ref[k] = string(bytes.Repeat([]byte{byte(i)}, i%50))
+		if err := db.Set([]byte(k), []byte(ref[k])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slot := masterCurrent(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	masterRewrite(t, path, DB_SIG_V08, slot)
+
+	db = &KV{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrOldFormat) {
+		db.Close()
+		t.Fatal("old format", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Upgrade(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tmp, _ := filepath.Glob(path + ".tmp.*"); len(tmp) != 0 {
+		t.Fatal("leftover files", tmp)
+	}
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvCheck(t, db, ref)
+	res, err := db.Verify()
+	if err != nil || !res.OK() {
+		t.Fatal(err, res.Errors)
+	}
+}
@@ -0,0 +1,296 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// the outcome of KV.Verify
+type VerifyResult struct {
+	Pages   uint64   // number of pages in use, including the master page
+	Keys    int      // number of keys in the tree and the buckets
+	Buckets int      // number of buckets
+	Free    int      // number of pages in the free list
+	Leaked  []uint64 // pages that are neither reachable nor in the free list
+	Doubled []uint64 // pages that are reachable more than once
+	Errors  []string // everything else that is wrong, by page
+}
+
+// is the database intact?
+func (res *VerifyResult) OK() bool {
+	return len(res.Leaked) == 0 && len(res.Doubled) == 0 && len(res.Errors) == 0
+}
+
+// the state of a Verify walk
+type verifier struct {
+	db        *KV
+	res       *VerifyResult
+	refs      map[uint64]int // times each page is referenced
+	leafDepth int            // the depth of the first leaf of a tree, -1 before it's found
+	partial   bool           // some pages couldn't be read, so not everything was reached
+}
+
+// check the whole database file:
+// the tree structure and key order, the overflow pages, the free list,
+// and that every page is used exactly once.
+// the committed state is checked, it waits for the write transaction to end.
+func (db *KV) Verify() (*VerifyResult, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.store == nil {
+		return nil, ErrClosed
+	}
+	v := &verifier{
+		db:   db,
+		res:  &VerifyResult{Pages: db.page.flushed},
+		refs: map[uint64]int{0: 1}, // the master page
+	}
+	verifyTree(v, db.tree.root)
+	verifyCatalog(v)
+	verifyFreeList(v)
+	// the pages under an unreadable page are unknown rather than leaked
+	for ptr := uint64(1); ptr < db.page.flushed && !v.partial; ptr++ {
+		if v.refs[ptr] == 0 {
+			v.res.Leaked = append(v.res.Leaked, ptr)
+		}
+	}
+	for ptr, n := range v.refs {
+		if n > 1 {
+			v.res.Doubled = append(v.res.Doubled, ptr)
+		}
+	}
+	sort.Slice(v.res.Doubled, func(i, j int) bool { return v.res.Doubled[i] < v.res.Doubled[j] })
+	return v.res, nil
+}
+
+func verifyErr(v *verifier, ptr uint64, format string, args ...any) {
+	msg := fmt.Sprintf("page %d: %s", ptr, fmt.Sprintf(format, args...))
+	v.res.Errors = append(v.res.Errors, msg)
+}
+
+// count a reference to a page, returns false if it was seen before
+func verifyMark(v *verifier, ptr uint64) bool {
+	v.refs[ptr]++
+	return v.refs[ptr] == 1
+}
+
+// check that the offsets and the KVs of a node stay inside the node,
+// so that the node accessors can be used on it
+func verifyLayout(node BNode) error {
+	n := node.nkeys()
+	if n == 0 || HEADER+10*int(n) > BTREE_NODE_SIZE {
+		return fmt.Errorf("bad number of keys %d", n)
+	}
+	base := HEADER + 10*int(n)
+	for i := uint16(0); i < n; i++ {
+		pos := base + int(node.getOffset(i))
+		if pos+4 > BTREE_NODE_SIZE {
+			return fmt.Errorf("bad offset of key %d", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node.data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node.data[pos+2:]) &^ VAL_REF)
+		next := pos + 4 + klen + vlen
+		if next > BTREE_NODE_SIZE || base+int(node.getOffset(i+1)) != next {
+			return fmt.Errorf("bad size of key %d", i)
+		}
+	}
+	return nil
+}
+
+// check the subtree at ptr.
+// its first key must be `first`, and all its keys must be less than `end` unless it's nil.
+func verifyNode(v *verifier, ptr uint64, depth int, first []byte, end []byte) {
+	if !verifyMark(v, ptr) {
+		return // reported as doubled, don't walk it again
+	}
+	node, err := v.db.pageGet(ptr)
+	if err == nil && node.btype() != BNODE_LEAF && node.btype() != BNODE_NODE {
+		err = fmt.Errorf("bad node type %d", node.btype())
+	}
+	if err == nil {
+		err = verifyLayout(node)
+	}
+	if err != nil {
+		verifyErr(v, ptr, "%v", err)
+		v.partial = true
+		return
+	}
+	btype := node.btype()
+	if !bytes.Equal(node.getKey(0), first) {
+		verifyErr(v, ptr, "first key %q differs from the parent key %q", node.getKey(0), first)
+	}
+	// keys are sorted within the node and less than the next key of the parent
+	for i := uint16(1); i < node.nkeys(); i++ {
+		if bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+			verifyErr(v, ptr, "key %d is out of order", i)
+		}
+	}
+	last := node.getKey(node.nkeys() - 1)
+	if end != nil && bytes.Compare(last, end) >= 0 {
+		verifyErr(v, ptr, "last key %q is not less than the next parent key %q", last, end)
+	}
+
+	if btype == BNODE_LEAF {
+		if v.leafDepth < 0 {
+			v.leafDepth = depth
+		} else if depth != v.leafDepth {
+			verifyErr(v, ptr, "leaf at depth %d, expected %d", depth, v.leafDepth)
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if len(node.getKey(i)) > 0 {
+				v.res.Keys++ // not the dummy key
+			}
+			if node.isValRef(i) {
+				verifyOverflow(v, ptr, node.getVal(i))
+			}
+		}
+		return
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kidEnd := end
+		if i+1 < node.nkeys() {
+			kidEnd = node.getKey(i + 1)
+		}
+		verifyNode(v, node.getPtr(i), depth+1, node.getKey(i), kidEnd)
+	}
+}
+
+// check a tree, returns the number of keys in it
+func verifyTree(v *verifier, root uint64) int {
+	keys := v.res.Keys
+	v.leafDepth = -1
+	if root != 0 {
+		verifyNode(v, root, 0, nil, nil)
+	}
+	return v.res.Keys - keys
+}
+
+// check the catalog and the bucket trees
+func verifyCatalog(v *verifier) {
+	catalog := &v.db.catalog
+	partial := v.partial
+	v.res.Buckets = verifyTree(v, catalog.root)
+	v.res.Keys -= v.res.Buckets // the names are not keys
+	if v.partial && !partial {
+		return // the entries can't be all read
+	}
+	iter := catalog.SeekGE(nil)
+	for ; iter.Valid(); iter.Next() {
+		name, val := iter.Deref()
+		if len(val) != CATALOG_VAL_SIZE {
+			verifyErr(v, catalog.root, "bad catalog entry %q", name)
+			continue
+		}
+		root := binary.LittleEndian.Uint64(val)
+		if root >= v.db.page.flushed {
+			verifyErr(v, catalog.root, "bucket %q has a bad root %d", name, root)
+			continue
+		}
+		verifyTree(v, root)
+	}
+	if err := iter.Err(); err != nil {
+		verifyErr(v, catalog.root, "%v", err)
+		v.partial = true
+	}
+}
+
+// check the overflow pages of a value in the leaf at ptr
+func verifyOverflow(v *verifier, ptr uint64, ref []byte) {
+	tree := BTree{get: func(page uint64) (BNode, error) {
+		if !verifyMark(v, page) {
+			return BNode{}, fmt.Errorf("overflow page %d is used twice", page)
+		}
+		return v.db.pageGet(page)
+	}}
+	err := overflowWalk(&tree, ref, OVERFLOW_CAP, func(uint64, []byte) error { return nil })
+	if err != nil {
+		verifyErr(v, ptr, "%v", err)
+		v.partial = true
+	}
+}
+
+// check the free list nodes and mark its items
+func verifyFreeList(v *verifier) {
+	fl := &v.db.free
+	if fl.headPage == 0 {
+		return // never created
+	}
+	v.res.Free = fl.Total()
+	ptr := fl.headPage
+	if !verifyMark(v, ptr) {
+		return
+	}
+	node, err := flGet(fl, ptr)
+	for seq := fl.headSeq; err == nil; seq++ {
+		if seq != fl.headSeq && seq2idx(seq) == 0 {
+			// move to the next node
+			if ptr == fl.tailPage {
+				err = fmt.Errorf("the tail node is full")
+				break
+			}
+			ptr = flnNext(node)
+			if !verifyMark(v, ptr) {
+				return
+			}
+			if node, err = flGet(fl, ptr); err != nil {
+				break
+			}
+		}
+		if seq == fl.tailSeq {
+			break
+		}
+		item := flnPtr(node, seq2idx(seq))
+		if item == 0 || item >= v.db.page.flushed {
+			verifyErr(v, ptr, "bad free page %d", item)
+			continue
+		}
+		verifyMark(v, item)
+	}
+	if err != nil {
+		verifyErr(v, ptr, "%v", err)
+		v.partial = true
+	} else if ptr != fl.tailPage {
+		verifyErr(v, ptr, "the free list ends at page %d, expected %d", ptr, fl.tailPage)
+	}
+}
+
+// replace the free list with a new one of the pages that the trees don't reach,
+// and commit it. the new nodes are appended, the old ones are free pages too.
+// it's for a free list that can't be read, the trees must be intact.
+func freeRebuild(db *KV) error {
+	v := &verifier{
+		db:   db,
+		res:  &VerifyResult{},
+		refs: map[uint64]int{0: 1}, // the master page
+	}
+	verifyTree(v, db.tree.root)
+	verifyCatalog(v)
+	if len(v.res.Errors) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorruptPage, v.res.Errors[0])
+	}
+	db.free.flData = flData{}
+	db.free.maxSeq = 0 // the new nodes are not taken from the list itself
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if v.refs[ptr] == 0 {
+			if err := db.free.PushTail(ptr); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flushPages(db); err != nil {
+		return err
+	}
+	// the new nodes are durable before the master page refers to them
+	if err := db.store.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := masterStore(db, masterCurrent(db)); err != nil {
+		return err
+	}
+	if err := db.store.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Verify()
+	if err != nil || !res.OK() {
+		t.Fatal("empty file", err, res.Errors)
+	}
+	r := rand.New(rand.NewSource(5))
+	keys := map[string]bool{}
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("k%05d", r.Intn(3000))
+		if r.Intn(3) == 0 {
+			if _, err := db.Del([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+			delete(keys, k)
+			continue
+		}
+		n := r.Intn(300)
+		if r.Intn(50) == 0 {
+			n = r.Intn(30000) // overflow chains
+		}
+		if err := db.Set([]byte(k), bytes.Repeat([]byte{1}, n)); err != nil {
+			t.Fatal(err)
+		}
+		keys[k] = true
+		if i%2000 == 0 {
+			res, err := db.Verify()
+			if err != nil || !res.OK() || res.Keys != len(keys) {
+				t.Fatal(i, err, res.Errors, res.Leaked, res.Doubled, res.Keys, len(keys))
+			}
+		}
+	}
+	res, err = db.Verify()
+	if err != nil || !res.OK() || res.Keys != len(keys) {
+		t.Fatal(err, res.Errors, res.Keys, len(keys))
+	}
+	root := db.tree.root
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pageFlip(t, path, root)
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if res, err := db.Verify(); err != nil || res.OK() {
+		t.Fatal("flipped page", err)
+	}
+}
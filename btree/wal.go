@@ -0,0 +1,319 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// in WAL mode a commit appends the updated pages to the write-ahead log
+// (the <db>.wal file) with a single fsync, instead of writing them to the main file.
+// the logged pages are served from memory until a checkpoint copies them
+// to the main file, updates the master page and empties the log.
+// a log left behind by a crash is replayed by KV.Open.
+//
+// the log record format.
+// | txid | btree_root | page_used | free_list | catalog | npages | size | (ptr | len | page) * npages | crc |
+// |  8B  |     8B     |    8B     |    32B    |   8B    |   4B   |  4B  |     (8B | 2B | len) ...     | 4B  |
+// a page is logged without its trailer and trailing zeros, so compressed pages take less room.
+// with a key, it's then encrypted like in the main file, see cryptSeal.
+// `size` is the size of the pages part.
+const WAL_HEADER = 8 + 8 + 8 + 32 + 8 + 4 + 4
+
+// a log left by a DB_SIG_V09 file has no catalog
+const WAL_HEADER_V09 = WAL_HEADER - 8
+
+// start a checkpoint when the log grows past this size
+const WAL_CHECKPOINT_SIZE = 16 << 20
+
+func walPath(db *KV) string {
+	return db.Path + ".wal"
+}
+
+// open the log and replay it. a log without WAL mode is only replayed and removed.
+// a read-only database keeps the replayed pages in memory and leaves the log as it is.
+func walOpen(db *KV) error {
+	flags := os.O_RDWR
+	if db.Options.WAL {
+		flags |= os.O_CREATE
+	}
+	if db.Options.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(walPath(db), flags, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // no log to replay
+	}
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+	db.wal.fp = fp
+	db.wal.pages = map[uint64][]byte{}
+	err = walReplay(db)
+	if db.Options.ReadOnly {
+		db.wal.fp = nil
+		fp.Close()
+		return err
+	}
+	if err == nil {
+		err = walCheckpoint(db) // start over with an empty log
+	}
+	// a log that failed to replay is kept as it is
+	if err != nil || !db.Options.WAL {
+		db.wal.fp = nil
+		fp.Close()
+	}
+	if err == nil && !db.Options.WAL {
+		if err = os.Remove(walPath(db)); err != nil {
+			err = fmt.Errorf("remove WAL: %w", err)
+		}
+	}
+	return err
+}
+
+// apply the complete records that follow the master page.
+// the log ends at the first record that is torn or out of sequence.
+func walReplay(db *KV) error {
+	fi, err := db.wal.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat WAL: %w", err)
+	}
+	maxSize := int64(BTREE_NODE_SIZE) // of a logged page
+	if db.crypt.aead != nil {
+		maxSize += CRYPT_NONCE_SIZE + int64(db.crypt.aead.Overhead())
+	}
+	hsize := int64(WAL_HEADER)
+	if db.wal.v09 {
+		hsize = WAL_HEADER_V09
+	}
+	offset := int64(0)
+	for {
+		header := make([]byte, hsize)
+		if _, err := db.wal.fp.ReadAt(header, offset); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read WAL: %w", err)
+		}
+		txid := binary.LittleEndian.Uint64(header[0:])
+		npages := int64(binary.LittleEndian.Uint32(header[hsize-8:]))
+		size := hsize + int64(binary.LittleEndian.Uint32(header[hsize-4:])) + 4
+		if txid != db.txid+1 && txid > db.txid {
+			break // a leftover from an older log
+		}
+		if offset+size > fi.Size() || size > hsize+npages*(8+2+maxSize)+4 {
+			break // torn
+		}
+		rec := make([]byte, size)
+		if _, err := db.wal.fp.ReadAt(rec, offset); err != nil {
+			return fmt.Errorf("read WAL: %w", err)
+		}
+		crc := binary.LittleEndian.Uint32(rec[size-4:])
+		if crc != crc32.Checksum(rec[:size-4], crcTable) {
+			break // torn
+		}
+		offset += size
+		db.wal.size = offset
+		if txid <= db.txid {
+			continue // already in the main file
+		}
+		slot := walDecodeHeader(rec, hsize)
+		if slot.used < db.page.flushed || slot.catalog >= slot.used {
+			return fmt.Errorf("%w: bad WAL record %d", ErrCorruptPage, txid)
+		}
+		pos := hsize
+		for i := int64(0); i < npages; i++ {
+			if pos+8+2 > size-4 {
+				return fmt.Errorf("%w: bad WAL record %d", ErrCorruptPage, txid)
+			}
+			ptr := binary.LittleEndian.Uint64(rec[pos:])
+			n := int64(binary.LittleEndian.Uint16(rec[pos+8:]))
+			pos += 8 + 2
+			if ptr == 0 || ptr >= slot.used || n > maxSize || pos+n > size-4 {
+				return fmt.Errorf("%w: bad WAL record %d", ErrCorruptPage, txid)
+			}
+			data := rec[pos : pos+n]
+			if db.crypt.aead != nil {
+				var err error
+				if data, err = cryptOpen(db.crypt.aead, ptr, data); err != nil {
+					return fmt.Errorf("WAL record %d: %w", txid, err)
+				}
+				if len(data) > BTREE_NODE_SIZE {
+					return fmt.Errorf("%w: bad WAL record %d", ErrCorruptPage, txid)
+				}
+			}
+			// the page as it's written to the main file
+			page := make([]byte, BTREE_PAGE_SIZE)
+			copy(page, data)
+			binary.LittleEndian.PutUint32(page[BTREE_NODE_SIZE:], pageChecksum(page))
+			db.wal.pages[ptr] = page
+			pos += n
+		}
+		db.txid = slot.txid
+		db.tree.root = slot.root
+		db.catalog.root = slot.catalog
+		db.page.flushed = slot.used
+		db.free.flData = slot.free
+	}
+	return nil
+}
+
+func walDecodeHeader(rec []byte, hsize int64) masterSlot {
+	slot := masterSlot{
+		txid: binary.LittleEndian.Uint64(rec[0:]),
+		root: binary.LittleEndian.Uint64(rec[8:]),
+		used: binary.LittleEndian.Uint64(rec[16:]),
+		free: flData{
+			headPage: binary.LittleEndian.Uint64(rec[24:]),
+			headSeq:  binary.LittleEndian.Uint64(rec[32:]),
+			tailPage: binary.LittleEndian.Uint64(rec[40:]),
+			tailSeq:  binary.LittleEndian.Uint64(rec[48:]),
+		},
+	}
+	if hsize == WAL_HEADER {
+		slot.catalog = binary.LittleEndian.Uint64(rec[56:])
+	}
+	return slot
+}
+
+// the commit in WAL mode: append the updated pages to the log
+func walWrite(db *KV) error {
+	// the pages as they are written to the main file
+	pages := map[uint64][]byte{}
+	logged := map[uint64][]byte{} // and as they are logged
+	size := WAL_HEADER + 4
+	for ptr, node := range db.page.updates {
+		if node != nil {
+			page := pageSeal(db, node)
+			pages[ptr] = page
+			logged[ptr] = walTrim(page)
+			if db.crypt.aead != nil {
+				var err error
+				if logged[ptr], err = cryptSeal(db.crypt.aead, ptr, logged[ptr]); err != nil {
+					return fmt.Errorf("write WAL: %w", err)
+				}
+			}
+			size += 8 + 2 + len(logged[ptr])
+		}
+	}
+	flushed := db.page.flushed + uint64(db.page.nappend)
+	// the header
+	rec := make([]byte, size)
+	binary.LittleEndian.PutUint64(rec[0:], db.txid+1)
+	binary.LittleEndian.PutUint64(rec[8:], db.tree.root)
+	binary.LittleEndian.PutUint64(rec[16:], flushed)
+	binary.LittleEndian.PutUint64(rec[24:], db.free.headPage)
+	binary.LittleEndian.PutUint64(rec[32:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(rec[40:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(rec[48:], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(rec[56:], db.catalog.root)
+	binary.LittleEndian.PutUint32(rec[64:], uint32(len(pages)))
+	binary.LittleEndian.PutUint32(rec[68:], uint32(size-WAL_HEADER-4))
+	// the pages
+	pos := WAL_HEADER
+	for ptr, data := range logged {
+		binary.LittleEndian.PutUint64(rec[pos:], ptr)
+		binary.LittleEndian.PutUint16(rec[pos+8:], uint16(len(data)))
+		pos += 8 + 2 + copy(rec[pos+8+2:], data)
+	}
+	crc := crc32.Checksum(rec[:size-4], crcTable)
+	binary.LittleEndian.PutUint32(rec[size-4:], crc)
+
+	// the single fsync of the commit is done by kvSync
+	if _, err := db.wal.fp.WriteAt(rec, db.wal.size); err != nil {
+		return fmt.Errorf("write WAL: %w", err)
+	}
+	db.wal.size += int64(size)
+	db.txid++
+	db.page.flushed = flushed
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.wal.mu.Lock()
+	for ptr, data := range pages {
+		db.wal.pages[ptr] = data
+	}
+	db.wal.mu.Unlock()
+	// copy the pages to the main file in the background
+	if db.wal.size >= WAL_CHECKPOINT_SIZE && !db.wal.running {
+		db.wal.running = true
+		go walBackground(db)
+	}
+	return nil
+}
+
+// the part of a page that is logged, the rest is zeros and the trailer
+func walTrim(page []byte) []byte {
+	return bytes.TrimRight(page[:BTREE_NODE_SIZE], "\x00")
+}
+
+// a committed page that is only in the log so far.
+// `pages` is the index of the writer or the one published to a reader.
+func walLookup(db *KV, pages map[uint64][]byte, ptr uint64) ([]byte, bool) {
+	db.wal.mu.RLock()
+	defer db.wal.mu.RUnlock()
+	page, ok := pages[ptr]
+	return page, ok
+}
+
+// the checkpointer, it waits for the write transaction
+func walBackground(db *KV) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.wal.running = false
+	if db.store == nil {
+		return // closed meanwhile
+	}
+	// a failure is retried by the next one, the log still has everything
+	walCheckpoint(db)
+}
+
+// copy the logged pages to the main file and empty the log.
+// called with the writer lock held.
+func walCheckpoint(db *KV) error {
+	if db.wal.size == 0 {
+		return nil
+	}
+	// the main file can't be changed before the log is durable
+	if err := walFsync(db, db.wal.fp.Sync); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	if err := db.store.Grow(db.page.flushed); err != nil {
+		return err
+	}
+	for ptr, page := range db.wal.pages {
+		if err := db.store.Write(ptr, page); err != nil {
+			return err
+		}
+	}
+	// the same order as syncPages, the log is only dropped after the master page
+	if err := walFsync(db, db.store.Sync); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := masterStore(db, masterCurrent(db)); err != nil {
+		return err
+	}
+	if err := walFsync(db, db.store.Sync); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := db.wal.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	if err := walFsync(db, db.wal.fp.Sync); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	// a new index, readers keep using the one they were published with
+	db.wal.size = 0
+	db.wal.pages = map[uint64][]byte{}
+	return nil
+}
+
+// checkpoints fsync in every SyncMode but SyncOff
+func walFsync(db *KV, fsync func() error) error {
+	if db.Options.Sync == SyncOff {
+		return nil
+	}
+	return fsync()
+}
@@ -0,0 +1,151 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func copyFile(t *testing.T, src string, dst string) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	db := &KV{Path: path, Options: Options{WAL: true}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// readers of the logged pages, while the checkpoints run
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				reader, err := db.BeginRead()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				it := reader.Scan(nil, nil)
+				for ; it.Valid(); it.Next() {
+					it.Deref()
+				}
+				if it.Err() != nil {
+					t.Error(it.Err())
+				}
+				reader.EndRead()
+			}
+		}()
+	}
+	ref := map[string]string{}
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 15000; i++ {
+		k := fmt.Sprintf("k%06d", r.Intn(3000))
+		v := string(bytes.Repeat([]byte{'v'}, r.Intn(4000)))
+		if r.Intn(4) == 0 {
+			delete(ref, k)
+			if _, err := db.Del([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			ref[k] = v
+			if err := db.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	kvCheck(t, db, ref)
+	res, err := db.Verify()
+	if err != nil || !res.OK() {
+		t.Fatal(err, res.Errors)
+	}
+	if len(db.wal.pages) == 0 {
+		t.Fatal("nothing in the log")
+	}
+
+	// a backup includes the logged pages
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	bpath := filepath.Join(dir, "backup")
+	if err := os.WriteFile(bpath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a crash, with a torn record at the end of the log
+	cpath := filepath.Join(dir, "crash")
+	copyFile(t, path, cpath)
+	copyFile(t, path+".wal", cpath+".wal")
+	fp, err := os.OpenFile(cpath+".wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write(bytes.Repeat([]byte{1}, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	// the log is replayed, then removed without WAL mode
+	for _, p := range []string{bpath, cpath} {
+		db2 := &KV{Path: p}
+		if err := db2.Open(); err != nil {
+			t.Fatal(p, err)
+		}
+		kvCheck(t, db2, ref)
+		res, err := db2.Verify()
+		if err != nil || !res.OK() {
+			t.Fatal(p, err, res.Errors)
+		}
+		if err := db2.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(p + ".wal"); !os.IsNotExist(err) {
+			t.Fatal("the log is left", p, err)
+		}
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("z%d", i)
+		ref[k] = k
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kvCheck(t, db, ref)
+	// the log is checkpointed on close
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path + ".wal"); err != nil || fi.Size() != 0 {
+		t.Fatal("the log is not empty", err)
+	}
+	db = &KV{Path: path, Options: Options{WAL: true}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvCheck(t, db, ref)
+	res, err = db.Verify()
+	if err != nil || !res.OK() {
+		t.Fatal(err, res.Errors)
+	}
+}
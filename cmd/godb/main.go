@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/abedmohammed/goDB/btree"
+	"github.com/abedmohammed/goDB/sql"
+	"github.com/abedmohammed/goDB/table"
+)
+
+const usage = `usage: godb <command> [arguments]
+
+commands:
+  check <file>    verify the structure of a database file
+  compact <file>  rewrite a database file without its free pages
+  backup <src> <dst>
+                  copy a database file to a new file
+  sql <file> <statement>
+                  run a SQL statement, a new file is created
+
+an encrypted file is opened with the key in hex in $GODB_KEY.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "check":
+		err = runCheck(args)
+	case "compact":
+		err = runCompact(args)
+	case "backup":
+		err = runBackup(args)
+	case "sql":
+		err = runSQL(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "godb:", err)
+		os.Exit(1)
+	}
+}
+
+// open an existing database file, KV.Open would create a missing one
+func openDB(path string, readOnly bool) (*btree.KV, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	opts, err := dbOptions(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	db := &btree.KV{Path: path, Options: opts}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// the options of the command line, with the key of $GODB_KEY
+func dbOptions(readOnly bool) (btree.Options, error) {
+	opts := btree.Options{ReadOnly: readOnly}
+	if key := os.Getenv("GODB_KEY"); key != "" {
+		var err error
+		if opts.Key, err = hex.DecodeString(key); err != nil {
+			return opts, fmt.Errorf("GODB_KEY: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+func runCheck(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: godb check <file>")
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	res, err := db.Verify()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pages: %d, keys: %d, buckets: %d, free pages: %d\n", res.Pages, res.Keys, res.Buckets, res.Free)
+	for _, msg := range res.Errors {
+		fmt.Println(msg)
+	}
+	if len(res.Leaked) > 0 {
+		fmt.Println("leaked pages:", res.Leaked)
+	}
+	if len(res.Doubled) > 0 {
+		fmt.Println("pages referenced more than once:", res.Doubled)
+	}
+	if !res.OK() {
+		return errors.New("the database is damaged")
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func runCompact(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: godb compact <file>")
+	}
+	before, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	db, err := openDB(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	after, err := os.Stat(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d -> %d bytes\n", before.Size(), after.Size())
+	return nil
+}
+
+// the source is opened read-only, so no other process can write it meanwhile.
+// a process that keeps the database open must call KV.Backup itself.
+func runBackup(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: godb backup <src> <dst>")
+	}
+	db, err := openDB(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fp, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(fp, 1<<20)
+	err = db.Backup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(args[1])
+		return err
+	}
+	return nil
+}
+
+// a query prints its rows separated by tabs, after a line of the column names
+func runSQL(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: godb sql <file> <statement>")
+	}
+	stmt, err := sql.Parse(args[1])
+	if err != nil {
+		return err
+	}
+	sel, query := stmt.(*sql.Select)
+	db := &sql.DB{}
+	db.Path = args[0]
+	if db.Options, err = dbOptions(false); err != nil {
+		return err
+	}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	if !query {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		n, err := sql.ExecStmt(tx, stmt)
+		if err != nil {
+			return err // aborted
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("%d rows\n", n)
+		return nil
+	}
+	reader, err := db.BeginRead()
+	if err != nil {
+		return err
+	}
+	defer reader.EndRead()
+	rows, err := sql.QueryStmt(reader, sel)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintln(w, strings.Join(rows.Cols, "\t"))
+	for rows.Next() {
+		fields := []string{}
+		for _, v := range rows.Row() {
+			fields = append(fields, formatValue(v))
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+func formatValue(v table.Value) string {
+	switch v.Type {
+	case table.TYPE_INT64:
+		return strconv.FormatInt(v.I64, 10)
+	case table.TYPE_FLOAT64:
+		return strconv.FormatFloat(v.F64, 'g', -1, 64)
+	case table.TYPE_BOOL:
+		return strconv.FormatBool(v.Bool)
+	case table.TYPE_BYTES:
+		return "x'" + hex.EncodeToString(v.Str) + "'"
+	default:
+		return string(v.Str)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/abedmohammed/goDB/btree"
 )
 
 func main() {
 	myTree := btree.NewC()
-	myTree.Add("0", "my name is rawanannananannannnaa")
+	if err := myTree.Add("0", "my name is rawanannananannannnaa"); err != nil {
+		fmt.Println(err)
+		return
+	}
 	myTree.PrintTree()
 }
@@ -0,0 +1,103 @@
+package sql
+
+import "github.com/abedmohammed/goDB/table"
+
+// a parsed statement, one of the types below
+type Stmt interface {
+	stmt()
+}
+
+// CREATE TABLE name (col type [PRIMARY KEY], ..., [PRIMARY KEY (col, ...)],
+// [UNIQUE] INDEX (col, ...), UNIQUE (col, ...))
+// the columns of the primary key are moved first, see table.TableDef.
+type CreateTable struct {
+	Def table.TableDef
+}
+
+// DROP TABLE name
+type DropTable struct {
+	Name string
+}
+
+// CREATE [UNIQUE] INDEX ON table (col, ...)
+type CreateIndex struct {
+	Table  string
+	Cols   []string
+	Unique bool
+}
+
+// INSERT [OR REPLACE] INTO table [(col, ...)] VALUES (expr, ...), ...
+type Insert struct {
+	Table   string
+	Cols    []string // nil for all the columns in the table order
+	Rows    [][]*Expr
+	Replace bool
+}
+
+// SELECT * | expr [AS name], ... FROM table [WHERE expr]
+// [ORDER BY expr [ASC | DESC], ...] [LIMIT n [OFFSET n]]
+type Select struct {
+	Table   string
+	Exprs   []*Expr // nil for *
+	Names   []string
+	Where   *Expr
+	OrderBy []Order
+	Limit   int64 // -1 for no limit
+	Offset  int64
+}
+
+type Order struct {
+	Expr *Expr
+	Desc bool
+}
+
+// UPDATE table SET col = expr, ... [WHERE expr]
+type Update struct {
+	Table string
+	Cols  []string
+	Exprs []*Expr
+	Where *Expr
+}
+
+// DELETE FROM table [WHERE expr]
+type Delete struct {
+	Table string
+	Where *Expr
+}
+
+func (*CreateTable) stmt() {}
+func (*DropTable) stmt()   {}
+func (*CreateIndex) stmt() {}
+func (*Insert) stmt()      {}
+func (*Select) stmt()      {}
+func (*Update) stmt()      {}
+func (*Delete) stmt()      {}
+
+// an expression
+type Expr struct {
+	Op    int
+	Value table.Value // OP_LIT
+	Name  string      // OP_COL
+	Args  []*Expr     // the operands
+}
+
+// the expression operators
+const (
+	OP_LIT = iota + 1 // a literal value
+	OP_COL            // a column
+	OP_NEG            // -a
+	OP_NOT
+	OP_ADD
+	OP_SUB
+	OP_MUL
+	OP_DIV
+	OP_MOD
+	OP_EQ
+	OP_NE
+	OP_LT
+	OP_LE
+	OP_GT
+	OP_GE
+	OP_AND
+	OP_OR
+)
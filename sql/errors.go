@@ -0,0 +1,14 @@
+package sql
+
+import "errors"
+
+// errors returned for bad statements.
+// they can be wrapped with more context, match them with errors.Is.
+// the errors of the table package are returned as they are.
+var (
+	ErrSyntax        = errors.New("Syntax error")
+	ErrUnknownColumn = errors.New("Unknown column")
+	ErrBadType       = errors.New("Type mismatch")
+	ErrDivideByZero  = errors.New("Division by zero")
+	ErrWrongStmt     = errors.New("Wrong kind of statement")
+)
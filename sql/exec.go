@@ -0,0 +1,629 @@
+package sql
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/abedmohammed/goDB/table"
+)
+
+// the reads that run a query, a *table.DBTX or a *table.DBReader
+type Reader interface {
+	TableDef(table string) (*table.TableDef, error)
+	Scan(table string, sc *table.Scanner) error
+}
+
+// parse and run a statement that isn't a query, returns the number of rows changed.
+// a statement that fails aborts the transaction, as it might be partly done.
+func Exec(tx *table.DBTX, query string) (int, error) {
+	stmt, err := Parse(query)
+	if err != nil {
+		return 0, err
+	}
+	return ExecStmt(tx, stmt)
+}
+
+// run a statement that isn't a query, see Exec
+func ExecStmt(tx *table.DBTX, stmt Stmt) (int, error) {
+	n, err := execStmt(tx, stmt)
+	if err != nil {
+		tx.Abort()
+		return 0, err
+	}
+	return n, nil
+}
+
+func execStmt(tx *table.DBTX, stmt Stmt) (int, error) {
+	switch s := stmt.(type) {
+	case *CreateTable:
+		return 0, tx.TableNew(&s.Def)
+	case *DropTable:
+		return 0, tx.TableDrop(s.Name)
+	case *CreateIndex:
+		return 0, tx.IndexNew(s.Table, s.Cols, s.Unique)
+	case *Insert:
+		return execInsert(tx, s)
+	case *Update:
+		return execUpdate(tx, s)
+	case *Delete:
+		return execDelete(tx, s)
+	case *Select:
+		return 0, fmt.Errorf("%w: use Query for a SELECT", ErrWrongStmt)
+	}
+	return 0, fmt.Errorf("%w: %T", ErrWrongStmt, stmt)
+}
+
+// parse and run a SELECT, the rows are read as they are iterated
+func Query(r Reader, query string) (*Rows, error) {
+	stmt, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(*Select)
+	if !ok {
+		return nil, fmt.Errorf("%w: use Exec for an update", ErrWrongStmt)
+	}
+	return QueryStmt(r, sel)
+}
+
+func execInsert(tx *table.DBTX, stmt *Insert) (int, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	cols := stmt.Cols
+	if cols == nil {
+		cols = declaredCols(tdef)
+	}
+	types := []uint32{}
+	for _, col := range cols {
+		idx := colIndex(tdef, col)
+		if idx < 0 {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownColumn, col)
+		}
+		types = append(types, tdef.Types[idx])
+	}
+	for _, row := range stmt.Rows {
+		if len(row) != len(cols) {
+			return 0, fmt.Errorf("%w: %d values for %d columns", table.ErrBadRecord, len(row), len(cols))
+		}
+		for i, expr := range row {
+			typ, err := exprType(expr, nil)
+			if err != nil {
+				return 0, err
+			}
+			if !coercible(typ, types[i]) {
+				return 0, fmt.Errorf("%w: column %s is %s, not %s", ErrBadType, cols[i], typeText[types[i]], typeText[typ])
+			}
+		}
+	}
+	for _, row := range stmt.Rows {
+		rec := table.Record{}
+		for i, expr := range row {
+			val, err := eval(expr, nil, nil)
+			if err == nil {
+				val, err = coerce(val, types[i], cols[i])
+			}
+			if err != nil {
+				return 0, err
+			}
+			rec.Cols = append(rec.Cols, cols[i])
+			rec.Vals = append(rec.Vals, val)
+		}
+		if stmt.Replace {
+			_, err = tx.Upsert(stmt.Table, rec)
+		} else {
+			var ok bool
+			ok, err = tx.Insert(stmt.Table, rec)
+			if err == nil && !ok {
+				err = fmt.Errorf("%w: %s primary key", table.ErrDuplicateKey, stmt.Table)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(stmt.Rows), nil
+}
+
+func execUpdate(tx *table.DBTX, stmt *Update) (int, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	idxs := []int{}
+	pkey := false
+	for i, col := range stmt.Cols {
+		idx := colIndex(tdef, col)
+		if idx < 0 {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownColumn, col)
+		}
+		typ, err := exprType(stmt.Exprs[i], tdef)
+		if err != nil {
+			return 0, err
+		}
+		if !coercible(typ, tdef.Types[idx]) {
+			return 0, fmt.Errorf("%w: column %s is %s, not %s", ErrBadType, col, typeText[tdef.Types[idx]], typeText[typ])
+		}
+		idxs = append(idxs, idx)
+		pkey = pkey || idx < tdef.PKeys
+	}
+	rows, err := matchRows(tx, tdef, stmt.Where)
+	if err != nil {
+		return 0, err
+	}
+	// the new values are computed from the old rows
+	updated := [][]table.Value{}
+	for _, row := range rows {
+		vals := slices.Clone(row)
+		for i, expr := range stmt.Exprs {
+			val, err := eval(expr, tdef, row)
+			if err == nil {
+				val, err = coerce(val, tdef.Types[idxs[i]], stmt.Cols[i])
+			}
+			if err != nil {
+				return 0, err
+			}
+			vals[idxs[i]] = val
+		}
+		updated = append(updated, vals)
+	}
+	if !pkey {
+		for _, vals := range updated {
+			if _, err := tx.Update(stmt.Table, record(tdef, vals)); err != nil {
+				return 0, err
+			}
+		}
+		return len(updated), nil
+	}
+	// the rows are moved to their new primary keys,
+	// which can be the old ones of the other rows
+	for _, row := range rows {
+		if _, err := tx.Delete(stmt.Table, record(tdef, row)); err != nil {
+			return 0, err
+		}
+	}
+	for _, vals := range updated {
+		ok, err := tx.Insert(stmt.Table, record(tdef, vals))
+		if err == nil && !ok {
+			err = fmt.Errorf("%w: %s primary key", table.ErrDuplicateKey, stmt.Table)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(updated), nil
+}
+
+func execDelete(tx *table.DBTX, stmt *Delete) (int, error) {
+	tdef, err := tx.TableDef(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := matchRows(tx, tdef, stmt.Where)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		if _, err := tx.Delete(stmt.Table, record(tdef, row)); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// the record of a row
+func record(tdef *table.TableDef, vals []table.Value) table.Record {
+	return table.Record{Cols: tdef.Cols, Vals: vals}
+}
+
+// check that a WHERE clause is a condition on the table
+func checkWhere(tdef *table.TableDef, where *Expr) error {
+	if where == nil {
+		return nil
+	}
+	typ, err := exprType(where, tdef)
+	if err == nil && typ != table.TYPE_BOOL {
+		err = fmt.Errorf("%w: WHERE is %s, not bool", ErrBadType, typeText[typ])
+	}
+	return err
+}
+
+// read the rows that match a WHERE clause, before the table is updated
+func matchRows(r Reader, tdef *table.TableDef, where *Expr) ([][]table.Value, error) {
+	if err := checkWhere(tdef, where); err != nil {
+		return nil, err
+	}
+	sc := planScan(tdef, where)
+	if err := r.Scan(tdef.Name, &sc); err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+	rows := [][]table.Value{}
+	for ; sc.Valid(); sc.Next() {
+		row, ok, err := scanRow(&sc, tdef, where)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows, sc.Err()
+}
+
+// the current row of a scan, and whether it matches the WHERE clause
+func scanRow(sc *table.Scanner, tdef *table.TableDef, where *Expr) ([]table.Value, bool, error) {
+	rec := table.Record{}
+	if err := sc.Deref(&rec); err != nil {
+		return nil, false, err
+	}
+	if where == nil {
+		return rec.Vals, true, nil
+	}
+	ok, err := eval(where, tdef, rec.Vals)
+	return rec.Vals, ok.Bool, err
+}
+
+// a comparison of a column with a constant in a WHERE clause
+type term struct {
+	col int
+	op  int
+	val table.Value
+}
+
+// the scan of the rows that can match a WHERE clause, by the key whose first columns
+// are the most constrained by it. the rows are still checked against the clause.
+func planScan(tdef *table.TableDef, where *Expr) table.Scanner {
+	terms := []term{}
+	collectTerms(tdef, where, &terms)
+	keys := [][]string{tdef.Cols[:tdef.PKeys]}
+	keys = append(keys, tdef.Indexes...)
+	best, bestScore := table.Scanner{}, 0
+	for _, key := range keys {
+		sc, score := planKey(tdef, key, terms)
+		if score > bestScore {
+			best, bestScore = sc, score
+		}
+	}
+	return best
+}
+
+// the range of a key: the first columns compared with =, then a range of the next one
+func planKey(tdef *table.TableDef, key []string, terms []term) (table.Scanner, int) {
+	sc := table.Scanner{Cmp1: table.CMP_GE, Cmp2: table.CMP_LE}
+	score := 0
+	for _, col := range key {
+		idx := colIndex(tdef, col)
+		eq, lower, upper := -1, -1, -1
+		for i, t := range terms {
+			switch {
+			case t.col != idx:
+			case t.op == OP_EQ:
+				eq = i
+			case t.op == OP_GT || t.op == OP_GE:
+				if lower < 0 || tighter(t, terms[lower], 1) {
+					lower = i
+				}
+			case t.op == OP_LT || t.op == OP_LE:
+				if upper < 0 || tighter(t, terms[upper], -1) {
+					upper = i
+				}
+			}
+		}
+		if eq >= 0 {
+			sc.Key1.Cols = append(sc.Key1.Cols, col)
+			sc.Key1.Vals = append(sc.Key1.Vals, terms[eq].val)
+			sc.Key2.Cols = append(sc.Key2.Cols, col)
+			sc.Key2.Vals = append(sc.Key2.Vals, terms[eq].val)
+			score += 2
+			continue
+		}
+		if lower >= 0 {
+			sc.Key1.Cols = append(sc.Key1.Cols, col)
+			sc.Key1.Vals = append(sc.Key1.Vals, terms[lower].val)
+			if terms[lower].op == OP_GT {
+				sc.Cmp1 = table.CMP_GT
+			}
+			score++
+		}
+		if upper >= 0 {
+			sc.Key2.Cols = append(sc.Key2.Cols, col)
+			sc.Key2.Vals = append(sc.Key2.Vals, terms[upper].val)
+			if terms[upper].op == OP_LT {
+				sc.Cmp2 = table.CMP_LT
+			}
+			score++
+		}
+		break
+	}
+	return sc, score
+}
+
+// whether a bound of a column is tighter than another one,
+// `dir` is 1 for lower bounds and -1 for upper bounds
+func tighter(a term, b term, dir int) bool {
+	if c := compareValues(a.val, b.val) * dir; c != 0 {
+		return c > 0
+	}
+	return a.op == OP_GT || a.op == OP_LT
+}
+
+// the comparisons of a column with a constant in the AND terms of a WHERE clause,
+// with the constant converted to the type of the column
+func collectTerms(tdef *table.TableDef, expr *Expr, terms *[]term) {
+	if expr == nil {
+		return
+	}
+	if expr.Op == OP_AND {
+		collectTerms(tdef, expr.Args[0], terms)
+		collectTerms(tdef, expr.Args[1], terms)
+		return
+	}
+	if expr.Op < OP_EQ || expr.Op > OP_GE || expr.Op == OP_NE {
+		return
+	}
+	col, val, op := expr.Args[0], expr.Args[1], expr.Op
+	if col.Op != OP_COL {
+		// the constant is on the left, a < col is col > a
+		col, val = val, col
+		op = map[int]int{OP_EQ: OP_EQ, OP_LT: OP_GT, OP_LE: OP_GE, OP_GT: OP_LT, OP_GE: OP_LE}[op]
+	}
+	if col.Op != OP_COL {
+		return
+	}
+	typ, err := exprType(val, nil)
+	if err != nil {
+		return // not a constant
+	}
+	idx := colIndex(tdef, col.Name)
+	if !coercible(typ, tdef.Types[idx]) {
+		return // a float constant for an int64 column is only checked row by row
+	}
+	v, err := eval(val, nil, nil)
+	if err == nil {
+		v, err = coerce(v, tdef.Types[idx], col.Name)
+	}
+	if err == nil {
+		*terms = append(*terms, term{col: idx, op: op, val: v})
+	}
+}
+
+// the rows of a query, read as they are iterated
+type Rows struct {
+	Cols  []string // the names of the columns
+	Types []uint32 // the types of the columns
+	// internals
+	sc     table.Scanner
+	tdef   *table.TableDef
+	stmt   *Select
+	sorted [][]table.Value // the rows of an ORDER BY, which are read at once
+	row    []table.Value
+	skip   int64           // the rows left to skip for OFFSET
+	left   int64           // the rows left to return for LIMIT, -1 for all
+	reader *table.DBReader // ended by Close, nil if owned by the caller
+	err    error
+}
+
+// run a SELECT, see Query
+func QueryStmt(r Reader, stmt *Select) (*Rows, error) {
+	tdef, err := r.TableDef(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	stmt = selectResolve(tdef, stmt)
+	rows := &Rows{tdef: tdef, stmt: stmt, skip: stmt.Offset, left: stmt.Limit}
+	for i, expr := range stmt.Exprs {
+		typ, err := exprType(expr, tdef)
+		if err != nil {
+			return nil, err
+		}
+		rows.Cols = append(rows.Cols, stmt.Names[i])
+		rows.Types = append(rows.Types, typ)
+	}
+	for _, order := range stmt.OrderBy {
+		if _, err := exprType(order.Expr, tdef); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkWhere(tdef, stmt.Where); err != nil {
+		return nil, err
+	}
+	if stmt.OrderBy != nil {
+		if rows.sorted, err = selectSort(r, tdef, stmt); err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+	rows.sc = planScan(tdef, stmt.Where)
+	if err := r.Scan(tdef.Name, &rows.sc); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// the expressions of SELECT *, and the ORDER BY of the output names
+func selectResolve(tdef *table.TableDef, stmt *Select) *Select {
+	s := *stmt
+	if s.Exprs == nil {
+		s.Names = declaredCols(tdef)
+		for _, col := range s.Names {
+			s.Exprs = append(s.Exprs, &Expr{Op: OP_COL, Name: col})
+		}
+	}
+	s.OrderBy = slices.Clone(s.OrderBy)
+	for i, order := range s.OrderBy {
+		if order.Expr.Op != OP_COL || colIndex(tdef, order.Expr.Name) >= 0 {
+			continue
+		}
+		if j := slices.Index(s.Names, order.Expr.Name); j >= 0 {
+			s.OrderBy[i].Expr = s.Exprs[j]
+		}
+	}
+	return &s
+}
+
+// read the output rows of an ORDER BY and sort them
+func selectSort(r Reader, tdef *table.TableDef, stmt *Select) ([][]table.Value, error) {
+	rows, err := matchRows(r, tdef, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	type sortRow struct {
+		keys []table.Value
+		out  []table.Value
+	}
+	sorted := []sortRow{}
+	for _, row := range rows {
+		sr := sortRow{}
+		for _, order := range stmt.OrderBy {
+			val, err := eval(order.Expr, tdef, row)
+			if err != nil {
+				return nil, err
+			}
+			sr.keys = append(sr.keys, val)
+		}
+		if sr.out, err = selectRow(tdef, stmt, row); err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, sr)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for k, order := range stmt.OrderBy {
+			c := compareValues(sorted[i].keys[k], sorted[j].keys[k])
+			if order.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	out := [][]table.Value{}
+	for _, sr := range sorted {
+		out = append(out, sr.out)
+	}
+	return out, nil
+}
+
+// the output columns of a row
+func selectRow(tdef *table.TableDef, stmt *Select, row []table.Value) ([]table.Value, error) {
+	out := []table.Value{}
+	for _, expr := range stmt.Exprs {
+		val, err := eval(expr, tdef, row)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+// the next output row before OFFSET and LIMIT
+func (rows *Rows) fetch() ([]table.Value, bool) {
+	if rows.stmt.OrderBy != nil {
+		if len(rows.sorted) == 0 {
+			return nil, false
+		}
+		row := rows.sorted[0]
+		rows.sorted = rows.sorted[1:]
+		return row, true
+	}
+	for ; rows.sc.Valid(); rows.sc.Next() {
+		row, ok, err := scanRow(&rows.sc, rows.tdef, rows.stmt.Where)
+		if err == nil && ok {
+			row, err = selectRow(rows.tdef, rows.stmt, row)
+		}
+		if err != nil {
+			rows.err = err
+			return nil, false
+		}
+		if ok {
+			rows.sc.Next()
+			return row, true
+		}
+	}
+	rows.err = rows.sc.Err()
+	return nil, false
+}
+
+// move to the next row, returns false at the end or on an error
+func (rows *Rows) Next() bool {
+	rows.row = nil
+	for rows.err == nil && rows.left != 0 {
+		row, ok := rows.fetch()
+		if !ok {
+			return false
+		}
+		if rows.skip > 0 {
+			rows.skip--
+			continue
+		}
+		if rows.left > 0 {
+			rows.left--
+		}
+		rows.row = row
+		return true
+	}
+	return false
+}
+
+// the values of the current row, in the order of Cols
+func (rows *Rows) Row() []table.Value {
+	return rows.row
+}
+
+// the error that stopped the rows, if any
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+// release the snapshot of DB.Query, the rows can't be used after that
+func (rows *Rows) Close() {
+	rows.sc.Close()
+	if rows.reader != nil {
+		rows.reader.EndRead()
+		rows.reader = nil
+	}
+}
+
+// a database of tables that runs SQL statements,
+// each one in a transaction or a snapshot of its own
+type DB struct {
+	table.DB
+}
+
+// parse and run a statement that isn't a query in a transaction of its own
+func (db *DB) Exec(query string) (int, error) {
+	stmt, err := Parse(query)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	n, err := ExecStmt(tx, stmt)
+	if err != nil {
+		return 0, err // aborted
+	}
+	return n, tx.Commit()
+}
+
+// parse and run a SELECT on the latest version,
+// the version is pinned until the rows are closed
+func (db *DB) Query(query string) (*Rows, error) {
+	reader, err := db.BeginRead()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := Query(reader, query)
+	if err != nil {
+		reader.EndRead()
+		return nil, err
+	}
+	rows.reader = reader
+	return rows, nil
+}
@@ -0,0 +1,248 @@
+package sql
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/abedmohammed/goDB/table"
+)
+
+// the names of the types in errors
+var typeText = map[uint32]string{
+	table.TYPE_BYTES: "bytes", table.TYPE_INT64: "int64", table.TYPE_STRING: "string",
+	table.TYPE_FLOAT64: "float64", table.TYPE_BOOL: "bool",
+}
+
+// the names of the operators in errors
+var opText = map[int]string{
+	OP_NEG: "-", OP_NOT: "NOT", OP_ADD: "+", OP_SUB: "-", OP_MUL: "*", OP_DIV: "/", OP_MOD: "%",
+	OP_EQ: "=", OP_NE: "!=", OP_LT: "<", OP_LE: "<=", OP_GT: ">", OP_GE: ">=", OP_AND: "AND", OP_OR: "OR",
+}
+
+func isNumber(typ uint32) bool {
+	return typ == table.TYPE_INT64 || typ == table.TYPE_FLOAT64
+}
+
+func isString(typ uint32) bool {
+	return typ == table.TYPE_STRING || typ == table.TYPE_BYTES
+}
+
+// the type of an expression over the columns of a table, nil for constants only.
+// it checks the columns and the types of the operands before anything is evaluated.
+func exprType(expr *Expr, tdef *table.TableDef) (uint32, error) {
+	switch expr.Op {
+	case OP_LIT:
+		return expr.Value.Type, nil
+	case OP_COL:
+		idx := -1
+		if tdef != nil {
+			idx = colIndex(tdef, expr.Name)
+		}
+		if idx < 0 {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownColumn, expr.Name)
+		}
+		return tdef.Types[idx], nil
+	}
+	types := []uint32{}
+	for _, arg := range expr.Args {
+		typ, err := exprType(arg, tdef)
+		if err != nil {
+			return 0, err
+		}
+		types = append(types, typ)
+	}
+	switch op := expr.Op; {
+	case op == OP_NEG && isNumber(types[0]):
+		return types[0], nil
+	case op == OP_NOT && types[0] == table.TYPE_BOOL:
+		return table.TYPE_BOOL, nil
+	case op == OP_MOD && types[0] == table.TYPE_INT64 && types[1] == table.TYPE_INT64:
+		return table.TYPE_INT64, nil
+	case op >= OP_ADD && op <= OP_DIV && isNumber(types[0]) && isNumber(types[1]):
+		if types[0] == table.TYPE_FLOAT64 || types[1] == table.TYPE_FLOAT64 {
+			return table.TYPE_FLOAT64, nil
+		}
+		return table.TYPE_INT64, nil
+	case op >= OP_EQ && op <= OP_GE && canCompare(types[0], types[1]):
+		return table.TYPE_BOOL, nil
+	case (op == OP_AND || op == OP_OR) && types[0] == table.TYPE_BOOL && types[1] == table.TYPE_BOOL:
+		return table.TYPE_BOOL, nil
+	}
+	names := []string{}
+	for _, typ := range types {
+		names = append(names, typeText[typ])
+	}
+	return 0, fmt.Errorf("%w: %s on %s", ErrBadType, opText[expr.Op], strings.Join(names, " and "))
+}
+
+// whether the values of 2 types can be compared
+func canCompare(a uint32, b uint32) bool {
+	return a == b || isNumber(a) && isNumber(b) || isString(a) && isString(b)
+}
+
+// the position of a column, -1 if there's none
+func colIndex(tdef *table.TableDef, col string) int {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
+// the columns in the order of CREATE TABLE, the primary key isn't moved first
+func declaredCols(tdef *table.TableDef) []string {
+	if tdef.Order != nil {
+		return tdef.Order
+	}
+	return tdef.Cols
+}
+
+// evaluate a well-typed expression over a row of the table, see exprType
+func eval(expr *Expr, tdef *table.TableDef, row []table.Value) (table.Value, error) {
+	switch expr.Op {
+	case OP_LIT:
+		return expr.Value, nil
+	case OP_COL:
+		return row[colIndex(tdef, expr.Name)], nil
+	}
+	args := []table.Value{}
+	for _, arg := range expr.Args {
+		// AND and OR stop at the first operand that decides them
+		if len(args) == 1 && (expr.Op == OP_AND && !args[0].Bool || expr.Op == OP_OR && args[0].Bool) {
+			return args[0], nil
+		}
+		val, err := eval(arg, tdef, row)
+		if err != nil {
+			return table.Value{}, err
+		}
+		args = append(args, val)
+	}
+	switch expr.Op {
+	case OP_NEG:
+		if args[0].Type == table.TYPE_INT64 {
+			return intValue(-args[0].I64), nil
+		}
+		return floatValue(-args[0].F64), nil
+	case OP_NOT:
+		return boolValue(!args[0].Bool), nil
+	case OP_AND, OP_OR:
+		return args[1], nil
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD:
+		return evalArith(expr.Op, args[0], args[1])
+	default:
+		c := compareValues(args[0], args[1])
+		switch expr.Op {
+		case OP_EQ:
+			return boolValue(c == 0), nil
+		case OP_NE:
+			return boolValue(c != 0), nil
+		case OP_LT:
+			return boolValue(c < 0), nil
+		case OP_LE:
+			return boolValue(c <= 0), nil
+		case OP_GT:
+			return boolValue(c > 0), nil
+		default:
+			return boolValue(c >= 0), nil
+		}
+	}
+}
+
+func evalArith(op int, a table.Value, b table.Value) (table.Value, error) {
+	if a.Type == table.TYPE_INT64 && b.Type == table.TYPE_INT64 {
+		if (op == OP_DIV || op == OP_MOD) && b.I64 == 0 {
+			return table.Value{}, ErrDivideByZero
+		}
+		switch op {
+		case OP_ADD:
+			return intValue(a.I64 + b.I64), nil
+		case OP_SUB:
+			return intValue(a.I64 - b.I64), nil
+		case OP_MUL:
+			return intValue(a.I64 * b.I64), nil
+		case OP_DIV:
+			return intValue(a.I64 / b.I64), nil
+		default:
+			return intValue(a.I64 % b.I64), nil
+		}
+	}
+	x, y := toFloat(a), toFloat(b)
+	switch op {
+	case OP_ADD:
+		return floatValue(x + y), nil
+	case OP_SUB:
+		return floatValue(x - y), nil
+	case OP_MUL:
+		return floatValue(x * y), nil
+	default:
+		if y == 0 {
+			return table.Value{}, ErrDivideByZero
+		}
+		return floatValue(x / y), nil
+	}
+}
+
+// compare 2 values of comparable types
+func compareValues(a table.Value, b table.Value) int {
+	switch {
+	case a.Type == table.TYPE_INT64 && b.Type == table.TYPE_INT64:
+		return cmp3(a.I64 < b.I64, a.I64 > b.I64)
+	case isNumber(a.Type):
+		x, y := toFloat(a), toFloat(b)
+		return cmp3(x < y, x > y)
+	case a.Type == table.TYPE_BOOL:
+		return cmp3(!a.Bool && b.Bool, a.Bool && !b.Bool)
+	default:
+		return bytes.Compare(a.Str, b.Str)
+	}
+}
+
+func cmp3(less bool, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v table.Value) float64 {
+	if v.Type == table.TYPE_INT64 {
+		return float64(v.I64)
+	}
+	return v.F64
+}
+
+func intValue(n int64) table.Value {
+	return table.Value{Type: table.TYPE_INT64, I64: n}
+}
+
+func floatValue(f float64) table.Value {
+	return table.Value{Type: table.TYPE_FLOAT64, F64: f}
+}
+
+func boolValue(b bool) table.Value {
+	return table.Value{Type: table.TYPE_BOOL, Bool: b}
+}
+
+// convert a value for a column of a type: an int64 to a float64,
+// and a string to bytes and back
+func coerce(v table.Value, typ uint32, col string) (table.Value, error) {
+	switch {
+	case v.Type == typ:
+		return v, nil
+	case v.Type == table.TYPE_INT64 && typ == table.TYPE_FLOAT64:
+		return floatValue(float64(v.I64)), nil
+	case isString(v.Type) && isString(typ):
+		return table.Value{Type: typ, Str: v.Str}, nil
+	}
+	return table.Value{}, fmt.Errorf("%w: column %s is %s, not %s", ErrBadType, col, typeText[typ], typeText[v.Type])
+}
+
+// whether a value of a type can be coerced to another one
+func coercible(from uint32, to uint32) bool {
+	return from == to || from == table.TYPE_INT64 && to == table.TYPE_FLOAT64 || isString(from) && isString(to)
+}
@@ -0,0 +1,148 @@
+package sql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// the token kinds
+const (
+	TOK_EOF   = iota
+	TOK_IDENT // a name or a keyword
+	TOK_INT
+	TOK_FLOAT
+	TOK_STR   // 'text', with '' for a quote
+	TOK_BYTES // x'hex'
+	TOK_SYM   // punctuation and operators
+)
+
+type token struct {
+	kind   int
+	text   string // the text of a string is unquoted, the one of bytes is decoded
+	quoted bool   // a "quoted" name, it's never a keyword
+	pos    int    // the byte range in the query
+	end    int
+}
+
+// the symbols, the longer ones first
+var symbols = []string{"<=", ">=", "!=", "<>", "(", ")", ",", ";", "*", "+", "-", "/", "%", "=", "<", ">"}
+
+// split a query into tokens, the last one is TOK_EOF
+func lex(query string) ([]token, error) {
+	toks := []token{}
+	for pos := 0; ; {
+		for pos < len(query) && strings.ContainsRune(" \t\r\n", rune(query[pos])) {
+			pos++
+		}
+		if strings.HasPrefix(query[pos:], "--") { // a comment to the end of the line
+			for pos < len(query) && query[pos] != '\n' {
+				pos++
+			}
+			continue
+		}
+		if pos >= len(query) {
+			return append(toks, token{kind: TOK_EOF, pos: pos, end: pos}), nil
+		}
+		tok, err := lexToken(query, pos)
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, tok)
+		pos = tok.end
+	}
+}
+
+func lexToken(query string, pos int) (token, error) {
+	ch := query[pos]
+	switch {
+	case (ch == 'x' || ch == 'X') && pos+1 < len(query) && query[pos+1] == '\'':
+		tok, err := lexString(query, pos+1)
+		if err != nil {
+			return token{}, err
+		}
+		data, err := hex.DecodeString(tok.text)
+		if err != nil {
+			return token{}, fmt.Errorf("%w: at %d: bad bytes literal", ErrSyntax, pos)
+		}
+		return token{kind: TOK_BYTES, text: string(data), pos: pos, end: tok.end}, nil
+	case isNameStart(ch):
+		end := pos
+		for end < len(query) && (isNameStart(query[end]) || isDigit(query[end])) {
+			end++
+		}
+		return token{kind: TOK_IDENT, text: query[pos:end], pos: pos, end: end}, nil
+	case isDigit(ch) || ch == '.' && pos+1 < len(query) && isDigit(query[pos+1]):
+		return lexNumber(query, pos), nil
+	case ch == '\'':
+		return lexString(query, pos)
+	case ch == '"':
+		end := strings.IndexByte(query[pos+1:], '"')
+		if end <= 0 {
+			return token{}, fmt.Errorf("%w: at %d: bad quoted name", ErrSyntax, pos)
+		}
+		end += pos + 1
+		return token{kind: TOK_IDENT, text: query[pos+1 : end], quoted: true, pos: pos, end: end + 1}, nil
+	}
+	for _, sym := range symbols {
+		if strings.HasPrefix(query[pos:], sym) {
+			return token{kind: TOK_SYM, text: sym, pos: pos, end: pos + len(sym)}, nil
+		}
+	}
+	return token{}, fmt.Errorf("%w: at %d: unexpected %q", ErrSyntax, pos, ch)
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z'
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+// digits, then an optional fraction and exponent for a float
+func lexNumber(query string, pos int) token {
+	end := pos
+	digits := func() {
+		for end < len(query) && isDigit(query[end]) {
+			end++
+		}
+	}
+	kind := TOK_INT
+	digits()
+	if end < len(query) && query[end] == '.' {
+		kind = TOK_FLOAT
+		end++
+		digits()
+	}
+	if end < len(query) && (query[end] == 'e' || query[end] == 'E') {
+		exp := end + 1
+		if exp < len(query) && (query[exp] == '+' || query[exp] == '-') {
+			exp++
+		}
+		if exp < len(query) && isDigit(query[exp]) {
+			kind = TOK_FLOAT
+			end = exp
+			digits()
+		}
+	}
+	return token{kind: kind, text: query[pos:end], pos: pos, end: end}
+}
+
+// a quoted string starting at pos
+func lexString(query string, pos int) (token, error) {
+	var text strings.Builder
+	for end := pos + 1; end < len(query); end++ {
+		if query[end] != '\'' {
+			text.WriteByte(query[end])
+			continue
+		}
+		if end+1 < len(query) && query[end+1] == '\'' {
+			text.WriteByte('\'')
+			end++
+			continue
+		}
+		return token{kind: TOK_STR, text: text.String(), pos: pos, end: end + 1}, nil
+	}
+	return token{}, fmt.Errorf("%w: at %d: unterminated string", ErrSyntax, pos)
+}
@@ -0,0 +1,577 @@
+package sql
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/abedmohammed/goDB/table"
+)
+
+// the words that can't be names unless they are quoted
+var keywords = map[string]bool{
+	"AND": true, "AS": true, "ASC": true, "BY": true, "CREATE": true,
+	"DELETE": true, "DESC": true, "DROP": true, "FALSE": true, "FROM": true,
+	"INDEX": true, "INSERT": true, "INTO": true, "KEY": true, "LIMIT": true,
+	"NOT": true, "OFFSET": true, "ON": true, "OR": true, "ORDER": true,
+	"PRIMARY": true, "REPLACE": true, "SELECT": true, "SET": true, "TABLE": true,
+	"TRUE": true, "UNIQUE": true, "UPDATE": true, "VALUES": true, "WHERE": true,
+}
+
+// the column type names
+var typeNames = map[string]uint32{
+	"INT64": table.TYPE_INT64, "INT": table.TYPE_INT64, "INTEGER": table.TYPE_INT64,
+	"FLOAT64": table.TYPE_FLOAT64, "FLOAT": table.TYPE_FLOAT64, "DOUBLE": table.TYPE_FLOAT64,
+	"STRING": table.TYPE_STRING, "TEXT": table.TYPE_STRING, "VARCHAR": table.TYPE_STRING,
+	"BYTES": table.TYPE_BYTES, "BLOB": table.TYPE_BYTES,
+	"BOOL": table.TYPE_BOOL, "BOOLEAN": table.TYPE_BOOL,
+}
+
+type parser struct {
+	query string
+	toks  []token
+	pos   int // the current token
+}
+
+// parse a statement, it can end with a ;
+func Parse(query string) (Stmt, error) {
+	toks, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{query: query, toks: toks}
+	stmt, err := parseStmt(p)
+	if err != nil {
+		return nil, err
+	}
+	p.symbol(";")
+	if p.peek().kind != TOK_EOF {
+		return nil, p.errorf("the end of the statement")
+	}
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != TOK_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+// a syntax error at the current token
+func (p *parser) errorf(expected string, args ...any) error {
+	tok := p.peek()
+	near := "the end"
+	if tok.kind != TOK_EOF {
+		near = strconv.Quote(p.query[tok.pos:tok.end])
+	}
+	return fmt.Errorf("%w: at %d: expected %s near %s", ErrSyntax, tok.pos, fmt.Sprintf(expected, args...), near)
+}
+
+// consume a keyword if it's the current token
+func (p *parser) keyword(kw string) bool {
+	tok := p.peek()
+	if tok.kind == TOK_IDENT && !tok.quoted && strings.EqualFold(tok.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.errorf("%s", kw)
+	}
+	return nil
+}
+
+// consume a symbol if it's the current token
+func (p *parser) symbol(sym string) bool {
+	tok := p.peek()
+	if tok.kind == TOK_SYM && tok.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.symbol(sym) {
+		return p.errorf("%q", sym)
+	}
+	return nil
+}
+
+// a table or column name
+func (p *parser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != TOK_IDENT || !tok.quoted && keywords[strings.ToUpper(tok.text)] {
+		return "", p.errorf("a name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// (name, ...)
+func (p *parser) nameList() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return names, p.expectSymbol(")")
+}
+
+func parseStmt(p *parser) (Stmt, error) {
+	switch {
+	case p.keyword("CREATE"):
+		if p.keyword("TABLE") {
+			return parseCreateTable(p)
+		}
+		unique := p.keyword("UNIQUE")
+		if err := p.expectKeyword("INDEX"); err != nil {
+			return nil, err
+		}
+		return parseCreateIndex(p, unique)
+	case p.keyword("DROP"):
+		if err := p.expectKeyword("TABLE"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return &DropTable{Name: name}, nil
+	case p.keyword("INSERT"):
+		return parseInsert(p)
+	case p.keyword("SELECT"):
+		return parseSelect(p)
+	case p.keyword("UPDATE"):
+		return parseUpdate(p)
+	case p.keyword("DELETE"):
+		return parseDelete(p)
+	}
+	return nil, p.errorf("a statement")
+}
+
+func parseCreateTable(p *parser) (Stmt, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	def := table.TableDef{Name: name}
+	var pkeys []string
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.keyword("PRIMARY"):
+			if err := p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			if pkeys != nil {
+				return nil, p.errorf("one primary key")
+			}
+			if pkeys, err = p.nameList(); err != nil {
+				return nil, err
+			}
+		case p.keyword("INDEX"):
+			cols, err := p.nameList()
+			if err != nil {
+				return nil, err
+			}
+			def.Indexes = append(def.Indexes, cols)
+			def.Unique = append(def.Unique, false)
+		case p.keyword("UNIQUE"):
+			p.keyword("INDEX")
+			cols, err := p.nameList()
+			if err != nil {
+				return nil, err
+			}
+			def.Indexes = append(def.Indexes, cols)
+			def.Unique = append(def.Unique, true)
+		default:
+			col, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			tok := p.peek()
+			typ, ok := typeNames[strings.ToUpper(tok.text)]
+			if tok.kind != TOK_IDENT || tok.quoted || !ok {
+				return nil, p.errorf("a column type")
+			}
+			p.pos++
+			def.Cols = append(def.Cols, col)
+			def.Types = append(def.Types, typ)
+			if p.keyword("PRIMARY") {
+				if err := p.expectKeyword("KEY"); err != nil {
+					return nil, err
+				}
+				if pkeys != nil {
+					return nil, p.errorf("one primary key")
+				}
+				pkeys = []string{col}
+			}
+		}
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	// move the primary key first, the declared order is kept for INSERT and SELECT *
+	order := slices.Clone(def.Cols)
+	for i, col := range pkeys {
+		j := slices.Index(def.Cols, col)
+		if j < i {
+			return nil, fmt.Errorf("%w: bad primary key column %s", table.ErrBadTableDef, col)
+		}
+		def.Cols = slices.Insert(slices.Delete(def.Cols, j, j+1), i, col)
+		typ := def.Types[j]
+		def.Types = slices.Insert(slices.Delete(def.Types, j, j+1), i, typ)
+	}
+	if !slices.Equal(order, def.Cols) {
+		def.Order = order
+	}
+	def.PKeys = len(pkeys)
+	return &CreateTable{Def: def}, nil
+}
+
+func parseCreateIndex(p *parser, unique bool) (Stmt, error) {
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	cols, err := p.nameList()
+	if err != nil {
+		return nil, err
+	}
+	return &CreateIndex{Table: name, Cols: cols, Unique: unique}, nil
+}
+
+func parseInsert(p *parser) (Stmt, error) {
+	stmt := &Insert{}
+	if p.keyword("OR") {
+		if err := p.expectKeyword("REPLACE"); err != nil {
+			return nil, err
+		}
+		stmt.Replace = true
+	}
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == TOK_SYM && p.peek().text == "(" {
+		if stmt.Cols, err = p.nameList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		row := []*Expr{}
+		for {
+			expr, err := parseExpr(p)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, expr)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if stmt.Cols != nil && len(row) != len(stmt.Cols) {
+			return nil, p.errorf("%d values", len(stmt.Cols))
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return stmt, nil
+}
+
+func parseSelect(p *parser) (Stmt, error) {
+	stmt := &Select{Limit: -1}
+	if !p.symbol("*") {
+		for {
+			start := p.peek().pos
+			expr, err := parseExpr(p)
+			if err != nil {
+				return nil, err
+			}
+			name := p.query[start:p.toks[p.pos-1].end]
+			if expr.Op == OP_COL {
+				name = expr.Name
+			}
+			if p.keyword("AS") {
+				if name, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			stmt.Exprs = append(stmt.Exprs, expr)
+			stmt.Names = append(stmt.Names, name)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = parseWhere(p); err != nil {
+		return nil, err
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := parseExpr(p)
+			if err != nil {
+				return nil, err
+			}
+			desc := p.keyword("DESC")
+			if !desc {
+				p.keyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, Order{Expr: expr, Desc: desc})
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		if stmt.Limit, err = parseCount(p); err != nil {
+			return nil, err
+		}
+		if p.keyword("OFFSET") {
+			if stmt.Offset, err = parseCount(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stmt, nil
+}
+
+// the number of LIMIT or OFFSET
+func parseCount(p *parser) (int64, error) {
+	tok := p.peek()
+	if tok.kind != TOK_INT {
+		return 0, p.errorf("a number")
+	}
+	n, err := strconv.ParseInt(tok.text, 10, 64)
+	if err != nil {
+		return 0, p.errorf("a smaller number")
+	}
+	p.pos++
+	return n, nil
+}
+
+// an optional WHERE clause
+func parseWhere(p *parser) (*Expr, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return parseExpr(p)
+}
+
+func parseUpdate(p *parser) (Stmt, error) {
+	stmt := &Update{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		expr, err := parseExpr(p)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Cols = append(stmt.Cols, col)
+		stmt.Exprs = append(stmt.Exprs, expr)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if stmt.Where, err = parseWhere(p); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func parseDelete(p *parser) (Stmt, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	stmt := &Delete{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = parseWhere(p); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// the expressions, from the lowest precedence:
+// OR, AND, NOT, comparisons, + -, * / %, unary -
+func parseExpr(p *parser) (*Expr, error) {
+	return parseBinary(p, 0)
+}
+
+// the binary operators of each precedence level
+var binaryOps = []map[string]int{
+	{"OR": OP_OR},
+	{"AND": OP_AND},
+	nil, // NOT
+	{"=": OP_EQ, "!=": OP_NE, "<>": OP_NE, "<": OP_LT, "<=": OP_LE, ">": OP_GT, ">=": OP_GE},
+	{"+": OP_ADD, "-": OP_SUB},
+	{"*": OP_MUL, "/": OP_DIV, "%": OP_MOD},
+}
+
+// the operator of the current token at a level, 0 if there's none
+func (p *parser) binaryOp(level int) int {
+	tok := p.peek()
+	if tok.kind == TOK_SYM || tok.kind == TOK_IDENT && !tok.quoted {
+		return binaryOps[level][strings.ToUpper(tok.text)]
+	}
+	return 0
+}
+
+func parseBinary(p *parser, level int) (*Expr, error) {
+	if level == len(binaryOps) {
+		return parseUnary(p)
+	}
+	if binaryOps[level] == nil {
+		if p.keyword("NOT") {
+			arg, err := parseBinary(p, level)
+			if err != nil {
+				return nil, err
+			}
+			return &Expr{Op: OP_NOT, Args: []*Expr{arg}}, nil
+		}
+		return parseBinary(p, level+1)
+	}
+	left, err := parseBinary(p, level+1)
+	if err != nil {
+		return nil, err
+	}
+	for op := p.binaryOp(level); op != 0; op = p.binaryOp(level) {
+		p.pos++
+		right, err := parseBinary(p, level+1)
+		if err != nil {
+			return nil, err
+		}
+		left = &Expr{Op: op, Args: []*Expr{left, right}}
+		if op >= OP_EQ && op <= OP_GE {
+			break // a < b < c is an error
+		}
+	}
+	return left, nil
+}
+
+func parseUnary(p *parser) (*Expr, error) {
+	if !p.symbol("-") {
+		return parsePrimary(p)
+	}
+	// the literal of the smallest int64 doesn't fit without its sign
+	if tok := p.peek(); tok.kind == TOK_INT {
+		if n, err := strconv.ParseInt("-"+tok.text, 10, 64); err == nil && n == math.MinInt64 {
+			p.pos++
+			return &Expr{Op: OP_LIT, Value: table.Value{Type: table.TYPE_INT64, I64: n}}, nil
+		}
+	}
+	arg, err := parseUnary(p)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{Op: OP_NEG, Args: []*Expr{arg}}, nil
+}
+
+func parsePrimary(p *parser) (*Expr, error) {
+	if p.symbol("(") {
+		expr, err := parseExpr(p)
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expectSymbol(")")
+	}
+	if p.keyword("TRUE") || p.keyword("FALSE") {
+		val := strings.EqualFold(p.toks[p.pos-1].text, "TRUE")
+		return &Expr{Op: OP_LIT, Value: table.Value{Type: table.TYPE_BOOL, Bool: val}}, nil
+	}
+	tok := p.peek()
+	lit := &Expr{Op: OP_LIT}
+	switch tok.kind {
+	case TOK_INT:
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("a smaller number")
+		}
+		lit.Value = table.Value{Type: table.TYPE_INT64, I64: n}
+	case TOK_FLOAT:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("a float")
+		}
+		lit.Value = table.Value{Type: table.TYPE_FLOAT64, F64: f}
+	case TOK_STR:
+		lit.Value = table.Value{Type: table.TYPE_STRING, Str: []byte(tok.text)}
+	case TOK_BYTES:
+		lit.Value = table.Value{Type: table.TYPE_BYTES, Str: []byte(tok.text)}
+	default:
+		name, err := p.name()
+		if err != nil {
+			return nil, p.errorf("an expression")
+		}
+		return &Expr{Op: OP_COL, Name: name}, nil
+	}
+	p.pos++
+	return lit, nil
+}
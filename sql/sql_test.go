@@ -0,0 +1,346 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/abedmohammed/goDB/btree"
+	"github.com/abedmohammed/goDB/table"
+)
+
+func testOpen(t *testing.T) *DB {
+	db := &DB{}
+	db.Path = filepath.Join(t.TempDir(), "db")
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testExec(t *testing.T, db *DB, query string) int {
+	t.Helper()
+	n, err := db.Exec(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// the rows of a query, separated by ';' with the values separated by ','
+func testQuery(t *testing.T, db *DB, query string) string {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		vals := []string{}
+		for _, v := range rows.Row() {
+			switch v.Type {
+			case table.TYPE_INT64:
+				vals = append(vals, fmt.Sprint(v.I64))
+			case table.TYPE_FLOAT64:
+				vals = append(vals, fmt.Sprint(v.F64))
+			case table.TYPE_BOOL:
+				vals = append(vals, fmt.Sprint(v.Bool))
+			default:
+				vals = append(vals, string(v.Str))
+			}
+		}
+		out = append(out, strings.Join(vals, ","))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return strings.Join(out, ";")
+}
+
+func TestSQL(t *testing.T) {
+	db := testOpen(t)
+	testExec(t, db, `CREATE TABLE users (name text, id int PRIMARY KEY, score float, ok bool, data blob, UNIQUE (name), INDEX (score))`)
+	if n := testExec(t, db, `INSERT INTO users (id, name, score, ok, data) VALUES (1, 'ann', 1.5, true, x'00ff'), (2, 'bob', 2, false, 'b'), (3, 'it''s', -1, true, '')`); n != 3 {
+		t.Fatal("bad count", n)
+	}
+	for query, want := range map[string]string{
+		`SELECT * FROM users`: "ann,1,1.5,true,\x00\xff;bob,2,2,false,b;it's,3,-1,true,",
+		`select name, score * 2 as s2, id % 2 = 1 FROM users WHERE score >= 1.5 order by s2 desc`: "bob,4,false;ann,3,true",
+		`SELECT id FROM users ORDER BY id DESC LIMIT 2 OFFSET 1`:                                  "2;1",
+		`SELECT name FROM users WHERE 2 > score AND id != 1 -- comment`:                           "it's",
+		`SELECT "id" FROM users WHERE "name" = 'bob'`:                                             "2",
+	} {
+		if got := testQuery(t, db, query); got != want {
+			t.Errorf("%s: %q", query, got)
+		}
+	}
+	rows, err := db.Query(`SELECT id + 1, score / 2, name FROM users LIMIT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rows.Cols) != "[id + 1 score / 2 name]" || fmt.Sprint(rows.Types) != "[2 4 3]" {
+		t.Fatal("bad columns", rows.Cols, rows.Types)
+	}
+	rows.Close()
+
+	testExec(t, db, `INSERT OR REPLACE INTO users VALUES ('zed', 1, 0, true, '')`)
+	if n := testExec(t, db, `UPDATE users SET id = id + 1, score = score + 1`); n != 3 {
+		t.Fatal("bad count", n)
+	}
+	if got := testQuery(t, db, `SELECT id, name, score FROM users`); got != "2,zed,1;3,bob,3;4,it's,0" {
+		t.Fatal("bad update", got)
+	}
+	if n := testExec(t, db, `DELETE FROM users WHERE NOT ok OR id > 3`); n != 2 {
+		t.Fatal("bad count", n)
+	}
+	if got := testQuery(t, db, `SELECT id FROM users`); got != "2" {
+		t.Fatal("bad delete", got)
+	}
+	testExec(t, db, `DROP TABLE users`)
+	if _, err := db.Query(`SELECT * FROM users`); !errors.Is(err, table.ErrTableNotFound) {
+		t.Fatal("dropped", err)
+	}
+}
+
+// the columns of INSERT without a column list and of SELECT * are in the declared order,
+// though the primary key is stored first
+func TestSQLColumnOrder(t *testing.T) {
+	db := testOpen(t)
+	testExec(t, db, `CREATE TABLE v (a int, b int, PRIMARY KEY (b))`)
+	testExec(t, db, `INSERT INTO v VALUES (10, 20), (30, 5)`)
+	testExec(t, db, `CREATE TABLE u (name text, id int PRIMARY KEY)`)
+	testExec(t, db, `INSERT INTO u VALUES ('x', 1)`)
+	testExec(t, db, `CREATE TABLE w (id int PRIMARY KEY, name text)`)
+	testExec(t, db, `INSERT INTO w VALUES (1, 'y')`)
+	check := func() {
+		t.Helper()
+		for query, want := range map[string]string{
+			`SELECT * FROM v`:            "30,5;10,20",
+			`SELECT b FROM v`:            "5;20",
+			`SELECT * FROM v ORDER BY a`: "10,20;30,5",
+			`SELECT * FROM u`:            "x,1",
+			`SELECT * FROM w`:            "1,y",
+		} {
+			if got := testQuery(t, db, query); got != want {
+				t.Errorf("%s: %q", query, got)
+			}
+		}
+		rows, err := db.Query(`SELECT * FROM u`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(rows.Cols) != "[name id]" || fmt.Sprint(rows.Types) != "[3 2]" {
+			t.Fatal("bad columns", rows.Cols, rows.Types)
+		}
+		rows.Close()
+	}
+	check()
+	// the order is kept with the table definition
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestSQLErrors(t *testing.T) {
+	db := testOpen(t)
+	testExec(t, db, `CREATE TABLE users (id int PRIMARY KEY, name text, UNIQUE (name))`)
+	testExec(t, db, `INSERT INTO users VALUES (1, 'ann')`)
+	for query, want := range map[string]error{
+		`INSERT INTO users VALUES (2, 'ann')`:  table.ErrDuplicateKey,
+		`INSERT INTO users VALUES (1, 'bob')`:  table.ErrDuplicateKey,
+		`INSERT INTO users VALUES ('x', 'x')`:  ErrBadType,
+		`INSERT INTO users (id) VALUES (1, 2)`: ErrSyntax,
+		`INSERT INTO users (id) VALUES (9)`:    table.ErrBadRecord,
+		`CREATE TABLE t (a int)`:               table.ErrBadTableDef,
+		`UPDATE users SET nope = 1`:            ErrUnknownColumn,
+		`SELECT * FROM users`:                  ErrWrongStmt,
+		`SELECT 'unterminated FROM users`:      ErrSyntax,
+		`SELECT FROM users`:                    ErrSyntax,
+		`SELECT * FROM users WHERE a < b < c`:  ErrSyntax,
+	} {
+		if _, err := db.Exec(query); !errors.Is(err, want) {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+	for query, want := range map[string]error{
+		`SELECT * FROM nope`:                 table.ErrTableNotFound,
+		`SELECT x FROM users`:                ErrUnknownColumn,
+		`SELECT * FROM users WHERE id`:       ErrBadType,
+		`SELECT * FROM users WHERE name + 1`: ErrBadType,
+		`DELETE FROM users`:                  ErrWrongStmt,
+	} {
+		if _, err := db.Query(query); !errors.Is(err, want) {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+	rows, err := db.Query(`SELECT * FROM users WHERE id / 0 = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	if !errors.Is(rows.Err(), ErrDivideByZero) {
+		t.Fatal("divide by zero", rows.Err())
+	}
+	rows.Close()
+}
+
+// a statement that fails halfway aborts the transaction
+func TestSQLAbort(t *testing.T) {
+	db := testOpen(t)
+	testExec(t, db, `CREATE TABLE t (a int PRIMARY KEY, b int, UNIQUE (b))`)
+	testExec(t, db, `INSERT INTO t VALUES (1, 10), (2, 20), (3, 30)`)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Exec(tx, `INSERT INTO t VALUES (4, 40)`); err != nil {
+		t.Fatal(err)
+	}
+	// the first rows are updated before the conflict
+	if _, err := Exec(tx, `UPDATE t SET b = 30 WHERE a < 3`); !errors.Is(err, table.ErrDuplicateKey) {
+		t.Fatal("conflict", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, btree.ErrTxDone) {
+		t.Fatal("not aborted", err)
+	}
+	if got := testQuery(t, db, `SELECT * FROM t`); got != "1,10;2,20;3,30" {
+		t.Fatal("partly updated", got)
+	}
+	// the writer is released
+	if _, err := db.Exec(`SELECT * FROM t`); !errors.Is(err, ErrWrongStmt) {
+		t.Fatal(err)
+	}
+	testExec(t, db, `DELETE FROM t WHERE a = 3`)
+}
+
+// the scan of several bounds of a column starts and stops at the tightest ones
+func TestPlanBounds(t *testing.T) {
+	tdef := &table.TableDef{
+		Name:  "t",
+		Types: []uint32{table.TYPE_INT64, table.TYPE_INT64},
+		Cols:  []string{"a", "b"},
+		PKeys: 1,
+	}
+	for where, want := range map[string]string{
+		`a > 1 AND a >= 5`:         ">= 5, <= ",
+		`a >= 5 AND a > 1`:         ">= 5, <= ",
+		`a >= 5 AND a > 5`:         "> 5, <= ",
+		`a < 9 AND a <= 3 AND 7>a`: ">= , <= 3",
+		`a <= 3 AND a < 3`:         ">= , < 3",
+		`4 <= a AND a < 8 AND 6>a`: ">= 4, < 6",
+	} {
+		stmt, err := Parse("SELECT * FROM t WHERE " + where)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := planScan(tdef, stmt.(*Select).Where)
+		got := fmt.Sprintf("%s %s, %s %s", cmpText(sc.Cmp1), keyText(sc.Key1), cmpText(sc.Cmp2), keyText(sc.Key2))
+		if got != want {
+			t.Errorf("%s: %q", where, got)
+		}
+	}
+}
+
+func cmpText(cmp int) string {
+	return map[int]string{table.CMP_GE: ">=", table.CMP_GT: ">", table.CMP_LE: "<=", table.CMP_LT: "<"}[cmp]
+}
+
+func keyText(rec table.Record) string {
+	vals := []string{}
+	for _, v := range rec.Vals {
+		vals = append(vals, fmt.Sprint(v.I64))
+	}
+	return strings.Join(vals, ",")
+}
+
+// the rows of random queries are the rows that match them one by one
+func TestPlanRandom(t *testing.T) {
+	db := testOpen(t)
+	testExec(t, db, `CREATE TABLE t (a int, b int, c text, d float, PRIMARY KEY (a, b), INDEX (c, d), INDEX (d))`)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 400; i++ {
+		testExec(t, db, fmt.Sprintf(`INSERT OR REPLACE INTO t VALUES (%d, %d, '%c', %d.5)`, r.Intn(10), r.Intn(10), 'a'+r.Intn(5), r.Intn(8)-4))
+	}
+	val := func(col string) string {
+		switch {
+		case col == "c":
+			return fmt.Sprintf("'%c'", 'a'+r.Intn(6))
+		case r.Intn(4) == 0:
+			return fmt.Sprintf("%d.5", r.Intn(10)-4)
+		default:
+			return fmt.Sprint(r.Intn(10) - 4)
+		}
+	}
+	all := strings.Split(testQuery(t, db, `SELECT a, b, c, d FROM t`), ";")
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.EndRead()
+	tdef, err := tx.TableDef("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols := []string{"a", "b", "c", "d"}
+	ops := []string{"=", "<", "<=", ">", ">=", "!="}
+	for i := 0; i < 1000; i++ {
+		conds := []string{}
+		for n := r.Intn(5); n > 0; n-- {
+			col := cols[r.Intn(len(cols))]
+			if r.Intn(4) == 0 {
+				conds = append(conds, val(col)+" "+ops[r.Intn(len(ops))]+" "+col)
+			} else {
+				conds = append(conds, col+" "+ops[r.Intn(len(ops))]+" "+val(col))
+			}
+		}
+		query := "SELECT a, b, c, d FROM t"
+		if len(conds) > 0 {
+			query += " WHERE " + strings.Join(conds, " AND ")
+		}
+		stmt, err := Parse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		where := stmt.(*Select).Where
+		want := []string{}
+		for _, line := range all {
+			f := strings.Split(line, ",")
+			var a, b int64
+			var d float64
+			fmt.Sscan(f[0], &a)
+			fmt.Sscan(f[1], &b)
+			fmt.Sscan(f[3], &d)
+			row := []table.Value{intValue(a), intValue(b), {Type: table.TYPE_STRING, Str: []byte(f[2])}, floatValue(d)}
+			if where != nil {
+				ok, err := eval(where, tdef, row)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok.Bool {
+					continue
+				}
+			}
+			want = append(want, line)
+		}
+		got := []string{}
+		if rows := testQuery(t, db, query); rows != "" {
+			got = strings.Split(rows, ";")
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, ";") != strings.Join(want, ";") {
+			t.Fatalf("%s\n%v\n%v\nplan %+v", query, got, want, planScan(tdef, where))
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package table
+
+import "errors"
+
+// errors returned for bad tables and records.
+// they can be wrapped with more context, match them with errors.Is.
+var (
+	ErrTableNotFound = errors.New("Table not found")
+	ErrTableExists   = errors.New("Table already exists")
+	ErrBadTableDef   = errors.New("Bad table definition")
+	ErrBadRecord     = errors.New("Record doesn't match the table")
+	ErrBadData       = errors.New("Bad row data")
+	ErrInternalTable = errors.New("Internal tables can't be updated")
+	ErrIndexExists   = errors.New("Index already exists")
+	ErrNoIndex       = errors.New("No index for the columns")
+	ErrDuplicateKey  = errors.New("Duplicate key in a unique index")
+)
@@ -0,0 +1,274 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/abedmohammed/goDB/btree"
+	"github.com/abedmohammed/goDB/tuple"
+)
+
+// a secondary index maps the columns of the index to the primary key.
+// it's a range of KV keys under a prefix of its own, with empty values:
+// | prefix | index columns, then the primary key columns |  =>  | |
+// |  4B BE |                tuple.Encode                 |      | |
+// the primary key columns make the keys unique, the ones that are not
+// declared for the index are appended to it. the rows and their index keys
+// are updated in the same transaction.
+//
+// a unique index allows one row for the values of its declared columns,
+// an update that would add another one fails with ErrDuplicateKey.
+
+// the columns of the keys of an index: the declared ones, then the rest of the primary key
+func indexNormalize(tdef *TableDef, cols []string) ([]string, error) {
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("%w: index without columns", ErrBadTableDef)
+	}
+	index := []string{}
+	for _, col := range cols {
+		if colIndex(tdef, col) < 0 {
+			return nil, fmt.Errorf("%w: unknown index column %s", ErrBadTableDef, col)
+		}
+		if slices.Contains(index, col) {
+			return nil, fmt.Errorf("%w: duplicate index column %s", ErrBadTableDef, col)
+		}
+		index = append(index, col)
+	}
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		if !slices.Contains(index, col) {
+			index = append(index, col)
+		}
+	}
+	if slices.Equal(index[:tdef.PKeys], tdef.Cols[:tdef.PKeys]) {
+		return nil, fmt.Errorf("%w: the index %v is the primary key", ErrBadTableDef, cols)
+	}
+	return index, nil
+}
+
+// the columns of the keys of an index, see indexNormalize
+func indexCols(tdef *TableDef, i int) []string {
+	index := slices.Clone(tdef.Indexes[i])
+	for _, col := range tdef.Cols[:tdef.PKeys] {
+		if !slices.Contains(index, col) {
+			index = append(index, col)
+		}
+	}
+	return index
+}
+
+// whether the declared columns of an index are unique
+func indexUnique(tdef *TableDef, i int) bool {
+	return i < len(tdef.Unique) && tdef.Unique[i]
+}
+
+// the position of an index with the columns, -1 if there's none
+func indexFind(tdef *TableDef, index []string) int {
+	for i := range tdef.Indexes {
+		if slices.Equal(indexCols(tdef, i), index) {
+			return i
+		}
+	}
+	return -1
+}
+
+// the index key of a row with the columns of `cols`,
+// `vals` are all the columns of the row
+func indexEncode(tdef *TableDef, i int, cols []string, vals []Value) []byte {
+	key := binary.BigEndian.AppendUint32(nil, tdef.IndexPrefixes[i])
+	for _, col := range cols {
+		key = tuple.Encode(key, vals[colIndex(tdef, col):][:1])
+	}
+	return key
+}
+
+// the KV key of a row in an index
+func indexKey(tdef *TableDef, i int, vals []Value) []byte {
+	return indexEncode(tdef, i, indexCols(tdef, i), vals)
+}
+
+// the primary key of the row of an index key
+func indexPKeys(tdef *TableDef, i int, key []byte) ([]Value, error) {
+	index := indexCols(tdef, i)
+	vals, err := tuple.Decode(key[4:])
+	if err == nil && len(vals) != len(index) {
+		err = fmt.Errorf("%d columns", len(vals))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: index of %s: %w", ErrBadData, tdef.Name, err)
+	}
+	pkeys := make([]Value, tdef.PKeys)
+	for j, col := range index {
+		if pos := colIndex(tdef, col); pos < tdef.PKeys {
+			pkeys[pos] = vals[j]
+		}
+	}
+	return pkeys, nil
+}
+
+// check that no other row has the values of the declared columns of a unique index
+func indexCheckUnique(tx *DBTX, tdef *TableDef, i int, vals []Value) error {
+	start := indexEncode(tdef, i, tdef.Indexes[i], vals)
+	pkey := encodeKey(tdef.Prefix, vals[:tdef.PKeys])
+	iter := tx.kv.Scan(start, tuple.PrefixEnd(start))
+	for ; iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		pkeys, err := indexPKeys(tdef, i, key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(encodeKey(tdef.Prefix, pkeys), pkey) {
+			return fmt.Errorf("%w: %s %v", ErrDuplicateKey, tdef.Name, tdef.Indexes[i])
+		}
+	}
+	return iter.Err()
+}
+
+// check the indexes before a row is changed from `old` to `vals`,
+// the old row can be nil. the new keys must fit, so that indexUpdate doesn't fail halfway,
+// and the unique indexes must not have the values of another row.
+func indexCheck(tx *DBTX, tdef *TableDef, old []Value, vals []Value) error {
+	for i := range tdef.Indexes {
+		if len(indexKey(tdef, i, vals)) > btree.BTREE_MAX_KEY_SIZE {
+			return fmt.Errorf("%w: %s %v", btree.ErrKeyTooLarge, tdef.Name, tdef.Indexes[i])
+		}
+		if !indexUnique(tdef, i) {
+			continue
+		}
+		if old != nil && bytes.Equal(indexKey(tdef, i, old), indexKey(tdef, i, vals)) {
+			continue
+		}
+		if err := indexCheckUnique(tx, tdef, i, vals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update the indexes from the old columns of a row to the new ones,
+// either can be nil for an insert or a delete
+func indexUpdate(tx *DBTX, tdef *TableDef, old []Value, vals []Value) error {
+	for i := range tdef.Indexes {
+		var oldKey, newKey []byte
+		if old != nil {
+			oldKey = indexKey(tdef, i, old)
+		}
+		if vals != nil {
+			newKey = indexKey(tdef, i, vals)
+		}
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		if oldKey != nil {
+			if _, err := tx.kv.Del(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			if err := tx.kv.Set(newKey, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add an index to a table, the existing rows are added to it.
+// a unique index fails with ErrDuplicateKey if they are not unique.
+func (tx *DBTX) IndexNew(table string, cols []string, unique bool) error {
+	tdef, err := writableTable(tx, table)
+	if err != nil {
+		return err
+	}
+	index, err := indexNormalize(tdef, cols)
+	if err != nil {
+		return err
+	}
+	if indexFind(tdef, index) >= 0 {
+		return fmt.Errorf("%w: %s %v", ErrIndexExists, table, cols)
+	}
+	prefix, err := allocPrefixes(tx, 1)
+	if err != nil {
+		return err
+	}
+	def := *tdef
+	def.Indexes = append(slices.Clone(tdef.Indexes), slices.Clone(cols))
+	def.Unique = make([]bool, len(def.Indexes))
+	for i := range def.Unique {
+		def.Unique[i] = indexUnique(tdef, i)
+	}
+	def.Unique[len(def.Unique)-1] = unique
+	def.IndexPrefixes = append(slices.Clone(tdef.IndexPrefixes), prefix)
+	if err := saveTableDef(tx, &def); err != nil {
+		return err
+	}
+	return indexBackfill(tx, &def, len(def.Indexes)-1)
+}
+
+// add the rows of a table to a new index, SCAN_BATCH at a time
+func indexBackfill(tx *DBTX, tdef *TableDef, i int) error {
+	start := binary.BigEndian.AppendUint32(nil, tdef.Prefix)
+	end := tuple.PrefixEnd(start)
+	for start != nil {
+		keys, rows := [][]byte{}, [][]Value{}
+		iter := tx.kv.Scan(start, end)
+		for ; iter.Valid() && len(keys) < SCAN_BATCH; iter.Next() {
+			key, val := iter.Deref()
+			vals, err := decodeRowKV(tdef, key, val)
+			if err != nil {
+				return err
+			}
+			keys, rows = append(keys, indexKey(tdef, i, vals)), append(rows, vals)
+			start = append(bytes.Clone(key), 0) // the next key
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if !iter.Valid() {
+			start = nil
+		}
+		for j, key := range keys {
+			if indexUnique(tdef, i) {
+				if err := indexCheckUnique(tx, tdef, i, rows[j]); err != nil {
+					return err
+				}
+			}
+			if err := tx.kv.Set(key, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// all the columns of a row from its KV pair
+func decodeRowKV(tdef *TableDef, key []byte, val []byte) ([]Value, error) {
+	if len(key) < 4 || binary.BigEndian.Uint32(key) != tdef.Prefix {
+		return nil, fmt.Errorf("%w: table %s: bad key prefix", ErrBadData, tdef.Name)
+	}
+	vals := make([]Value, len(tdef.Cols))
+	for i := 0; i < tdef.PKeys; i++ {
+		vals[i] = Value{Type: tdef.Types[i]}
+	}
+	if err := decodeValues(key[4:], vals[:tdef.PKeys]); err != nil {
+		return nil, fmt.Errorf("table %s: %w", tdef.Name, err)
+	}
+	if err := decodeRow(tdef, val, vals); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// add an index to a table in a transaction of its own
+func (db *DB) IndexNew(table string, cols []string, unique bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.IndexNew(table, cols, unique); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,332 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/abedmohammed/goDB/btree"
+)
+
+// the ids of the rows of a scan
+func scanIDs(t *testing.T, sc *Scanner) []int64 {
+	ids := []int64{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.Deref(&rec); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rec.Get("id").I64)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+	return ids
+}
+
+func TestIndex(t *testing.T) {
+	db, _ := testOpen(t)
+	defer db.Close()
+	tdef := &TableDef{
+		Name:    "p",
+		Types:   []uint32{TYPE_INT64, TYPE_STRING, TYPE_INT64, TYPE_FLOAT64},
+		Cols:    []string{"id", "name", "age", "score"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}, {"age", "score"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	// an index of the primary key
+	xdef := &TableDef{Name: "x", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1, Indexes: [][]string{{"id"}}}
+	if err := db.TableNew(xdef); !errors.Is(err, ErrBadTableDef) {
+		t.Fatal("bad index", err)
+	}
+	r := rand.New(rand.NewSource(2))
+	type row struct {
+		name  string
+		age   int64
+		score float64
+	}
+	rows := map[int64]row{}
+	for i := 0; i < 3000; i++ {
+		id := int64(r.Intn(500)) - 250
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Intn(4) == 0 {
+			ok, err := tx.Delete("p", *(&Record{}).AddInt64("id", id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, had := rows[id]
+			if ok != had {
+				t.Fatal("delete", id, ok)
+			}
+			delete(rows, id)
+		} else {
+			rw := row{fmt.Sprint("n", r.Intn(50)), int64(r.Intn(20)) - 10, float64(r.Intn(7)) - 3}
+			rec := (&Record{}).AddInt64("id", id).AddStr("name", rw.name).AddInt64("age", rw.age).AddFloat64("score", rw.score)
+			if _, err := tx.Upsert("p", *rec); err != nil {
+				t.Fatal(err)
+			}
+			rows[id] = rw
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1500 {
+			// backfilled, then maintained
+			if err := db.IndexNew("p", []string{"score"}, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.IndexNew("p", []string{"score", "id"}, false); !errors.Is(err, ErrIndexExists) {
+				t.Fatal("index exists", err)
+			}
+		}
+	}
+	// the rows of a scan are the matching rows in the order of the key
+	check := func(sc Scanner, want func(id int64, rw row) bool, order func(a, b int64) bool) {
+		t.Helper()
+		if err := db.Scan("p", &sc); err != nil {
+			t.Fatal(err)
+		}
+		got := scanIDs(t, &sc)
+		exp := []int64{}
+		for id, rw := range rows {
+			if want(id, rw) {
+				exp = append(exp, id)
+			}
+		}
+		sort.Slice(exp, func(i, j int) bool { return order(exp[i], exp[j]) })
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Fatalf("scan %+v\n%v\n%v", sc, got, exp)
+		}
+	}
+	byID := func(a, b int64) bool { return a < b }
+	check(Scanner{}, func(int64, row) bool { return true }, byID)
+	check(Scanner{Cmp1: CMP_GT, Key1: *(&Record{}).AddInt64("id", -10), Cmp2: CMP_LE, Key2: *(&Record{}).AddInt64("id", 30)},
+		func(id int64, _ row) bool { return id > -10 && id <= 30 }, byID)
+	check(Scanner{Key1: *(&Record{}).AddStr("name", "n7"), Key2: *(&Record{}).AddStr("name", "n7")},
+		func(_ int64, rw row) bool { return rw.name == "n7" }, byID)
+	byAgeScore := func(a, b int64) bool {
+		ra, rb := rows[a], rows[b]
+		if ra.age != rb.age {
+			return ra.age < rb.age
+		}
+		if ra.score != rb.score {
+			return ra.score < rb.score
+		}
+		return a < b
+	}
+	check(Scanner{Cmp1: CMP_GE, Key1: *(&Record{}).AddInt64("age", -2), Cmp2: CMP_LT, Key2: *(&Record{}).AddInt64("age", 3)},
+		func(_ int64, rw row) bool { return rw.age >= -2 && rw.age < 3 }, byAgeScore)
+	check(Scanner{Cmp1: CMP_GT, Key1: *(&Record{}).AddFloat64("score", 1).AddInt64("age", 0), Cmp2: CMP_LE, Key2: *(&Record{}).AddInt64("age", 0).AddFloat64("score", 3)},
+		func(_ int64, rw row) bool { return rw.age == 0 && rw.score > 1 && rw.score <= 3 }, byAgeScore)
+	check(Scanner{Cmp1: CMP_GE, Key1: *(&Record{}).AddFloat64("score", 0)},
+		func(_ int64, rw row) bool { return rw.score >= 0 }, func(a, b int64) bool {
+			if rows[a].score != rows[b].score {
+				return rows[a].score < rows[b].score
+			}
+			return a < b
+		})
+	sc := Scanner{Key1: *(&Record{}).AddFloat64("score", 0).AddInt64("age", 1).AddStr("name", "x")}
+	if err := db.Scan("p", &sc); !errors.Is(err, ErrNoIndex) {
+		t.Fatal("no index", err)
+	}
+	// every index has a key per row
+	reader, err := db.kv.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.EndRead()
+	if tdef, err = getTableDef(reader, nil, "p"); err != nil {
+		t.Fatal(err)
+	}
+	for i, prefix := range tdef.IndexPrefixes {
+		n := 0
+		iter := reader.Scan(scanRange(prefix, nil, 0, nil, 0))
+		for ; iter.Valid(); iter.Next() {
+			n++
+		}
+		iter.Close()
+		if n != len(rows) {
+			t.Fatal("index keys", i, n, len(rows))
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	db, _ := testOpen(t)
+	defer db.Close()
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_STRING, TYPE_STRING},
+		Cols:    []string{"id", "username", "email"},
+		PKeys:   1,
+		Indexes: [][]string{{"username"}},
+		Unique:  []bool{true},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	u := func(id int64, name, email string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("username", name).AddStr("email", email)
+	}
+	if ok, err := db.Insert("users", u(1, "ann", "a@x")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, err := db.Insert("users", u(2, "ann", "b@x")); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if ok, err := db.Insert("users", u(1, "bob", "b@x")); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if ok, err := db.Upsert("users", u(1, "ann", "new@x")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if ok, err := db.Insert("users", u(2, "bob", "b@x")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, err := db.Update("users", u(2, "ann", "b@x")); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if ok, err := db.Update("users", u(1, "carl", "c@x")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if ok, err := db.Insert("users", u(3, "ann", "a@x")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	// a unique index is checked by the backfill, then by the updates
+	if err := db.IndexNew("users", []string{"email"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert("users", u(4, "dan", "a@x")); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if ok, err := db.Insert("users", u(4, "dan", "d@x")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, err := db.Update("users", u(4, "dan", "a@x")); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if err := db.IndexNew("users", []string{"username", "email"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert("users", u(5, "eve", "e@x")); err != nil {
+		t.Fatal(err)
+	}
+	// a conflict undoes the row, the transaction goes on
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Upsert("users", u(6, "x", "x@x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Upsert("users", u(7, "x", "y@x")); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if _, err := tx.Upsert("users", u(6, "ann", "z@x")); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if ok, err := tx.Get("users", (&Record{}).AddInt64("id", 7)); ok || err != nil {
+		t.Fatal("undone insert", ok, err)
+	}
+	row := (&Record{}).AddInt64("id", 6)
+	if ok, err := tx.Get("users", row); !ok || err != nil || string(row.Get("email").Str) != "x@x" {
+		t.Fatal("undone update", ok, err)
+	}
+	if err := tx.IndexNew("users", []string{"email", "username"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"x", "ann"} {
+		sc := Scanner{Key1: *(&Record{}).AddStr("username", name), Key2: *(&Record{}).AddStr("username", name)}
+		if err := db.Scan("users", &sc); err != nil {
+			t.Fatal(err)
+		}
+		if ids := scanIDs(t, &sc); fmt.Sprint(ids) != map[string]string{"x": "[6]", "ann": "[3]"}[name] {
+			t.Fatal("index keys", name, ids)
+		}
+	}
+
+	// a backfill that fails
+	if err := db.IndexNew("users", []string{"username", "id"}, false); !errors.Is(err, ErrIndexExists) {
+		t.Fatal(err)
+	}
+	if err := db.TableNew(&TableDef{Name: "t2", Types: []uint32{TYPE_INT64, TYPE_INT64}, Cols: []string{"id", "v"}, PKeys: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := db.Insert("t2", *(&Record{}).AddInt64("id", int64(i)).AddInt64("v", int64(i%49))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.IndexNew("t2", []string{"v"}, true); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal(err)
+	}
+	if err := db.IndexNew("t2", []string{"v"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.IndexNew("users", []string{"id", "email"}, true); !errors.Is(err, ErrBadTableDef) {
+		t.Fatal(err)
+	}
+}
+
+// an index key that is too large fails the update, without a row left unindexed
+func TestIndexKeySize(t *testing.T) {
+	db, _ := testOpen(t)
+	defer db.Close()
+	tdef := &TableDef{
+		Name:    "docs",
+		Types:   []uint32{TYPE_INT64, TYPE_STRING},
+		Cols:    []string{"id", "title"},
+		PKeys:   1,
+		Indexes: [][]string{{"title"}},
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	doc := func(id int64, title string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("title", title)
+	}
+	long := strings.Repeat("t", 990)
+	if ok, err := db.Insert("docs", doc(1, "short")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tx.Insert("docs", doc(2, long)); ok || !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Fatal("insert", ok, err)
+	}
+	if ok, err := tx.Update("docs", doc(1, long)); ok || !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Fatal("update", ok, err)
+	}
+	if ok, err := tx.Get("docs", (&Record{}).AddInt64("id", 2)); ok || err != nil {
+		t.Fatal("undone insert", ok, err)
+	}
+	row := (&Record{}).AddInt64("id", 1)
+	if ok, err := tx.Get("docs", row); !ok || err != nil || string(row.Get("title").Str) != "short" {
+		t.Fatal("undone update", ok, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	sc := Scanner{Key1: *(&Record{}).AddStr("title", "short"), Key2: *(&Record{}).AddStr("title", "short")}
+	if err := db.Scan("docs", &sc); err != nil {
+		t.Fatal(err)
+	}
+	if ids := scanIDs(t, &sc); fmt.Sprint(ids) != "[1]" {
+		t.Fatal("index keys", ids)
+	}
+}
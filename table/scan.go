@@ -0,0 +1,229 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/abedmohammed/goDB/btree"
+	"github.com/abedmohammed/goDB/tuple"
+)
+
+// the comparisons of the scan bounds
+const (
+	CMP_GE = 3 // >=
+	CMP_GT = 2 // >
+	CMP_LT = -2
+	CMP_LE = -3
+)
+
+// a range scan of a table, in the order of the primary key or of an index.
+// the bounds are records with the first columns of the primary key or of an index,
+// the first key that has the columns of both is used.
+// an empty record is no bound, and a zero Cmp is inclusive.
+type Scanner struct {
+	Cmp1 int // CMP_GE or CMP_GT
+	Cmp2 int // CMP_LE or CMP_LT
+	Key1 Record
+	Key2 Record
+	// internals
+	kv     kvReader
+	tdef   *TableDef
+	index  int // -1 for the primary key
+	iter   *btree.KVIter
+	reader *btree.KVReader // released by Close, nil if owned by the caller
+	err    error
+}
+
+// the key to scan by, and the bounds in its column order
+func scanIndex(tdef *TableDef, sc *Scanner) (int, []Value, []Value, error) {
+	cols := sc.Key1.Cols
+	if len(sc.Key2.Cols) > len(cols) {
+		cols = sc.Key2.Cols
+	}
+	for i := -1; i < len(tdef.Indexes); i++ {
+		index := tdef.Cols[:tdef.PKeys]
+		if i >= 0 {
+			index = indexCols(tdef, i)
+		}
+		if !scanCols(sc.Key1.Cols, index) || !scanCols(sc.Key2.Cols, index) {
+			continue
+		}
+		key1, err := scanKey(tdef, &sc.Key1, index[:len(sc.Key1.Cols)])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		key2, err := scanKey(tdef, &sc.Key2, index[:len(sc.Key2.Cols)])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return i, key1, key2, nil
+	}
+	return 0, nil, nil, fmt.Errorf("%w: %s %v", ErrNoIndex, tdef.Name, cols)
+}
+
+// whether the columns are the first columns of the key in any order
+func scanCols(cols []string, index []string) bool {
+	if len(cols) > len(index) {
+		return false
+	}
+	for _, col := range cols {
+		if !slices.Contains(index[:len(cols)], col) {
+			return false
+		}
+	}
+	return true
+}
+
+// the values of a bound in the column order of the key, nil for no bound
+func scanKey(tdef *TableDef, rec *Record, cols []string) ([]Value, error) {
+	if len(rec.Cols) == 0 {
+		return nil, nil
+	}
+	if len(rec.Vals) != len(rec.Cols) {
+		return nil, fmt.Errorf("%w: %d columns, %d values", ErrBadRecord, len(rec.Cols), len(rec.Vals))
+	}
+	vals := make([]Value, len(cols))
+	for i, col := range cols {
+		v := rec.Get(col)
+		if v == nil {
+			return nil, fmt.Errorf("%w: missing column %s", ErrBadRecord, col)
+		}
+		if v.Type != tdef.Types[colIndex(tdef, col)] {
+			return nil, fmt.Errorf("%w: bad type of column %s", ErrBadRecord, col)
+		}
+		vals[i] = *v
+	}
+	return vals, nil
+}
+
+// the KV range of a scan.
+// the keys that start with the values of a bound are all above or below it.
+func scanRange(prefix uint32, key1 []Value, cmp1 int, key2 []Value, cmp2 int) ([]byte, []byte) {
+	// clipped, as both bounds are appended to it
+	base := slices.Clip(binary.BigEndian.AppendUint32(nil, prefix))
+	start, end := base, tuple.PrefixEnd(base)
+	if key1 != nil {
+		start = tuple.Encode(base, key1)
+		if cmp1 == CMP_GT {
+			start = tuple.PrefixEnd(start)
+		}
+	}
+	if key2 != nil {
+		end = tuple.Encode(base, key2)
+		if cmp2 != CMP_LT {
+			end = tuple.PrefixEnd(end)
+		}
+	}
+	return start, end
+}
+
+// start a scan in the version that `kv` reads
+func scanStart(kv kvReader, tdef *TableDef, sc *Scanner) error {
+	if sc.Cmp1 != 0 && sc.Cmp1 != CMP_GE && sc.Cmp1 != CMP_GT {
+		return fmt.Errorf("%w: bad Cmp1", ErrBadRecord)
+	}
+	if sc.Cmp2 != 0 && sc.Cmp2 != CMP_LE && sc.Cmp2 != CMP_LT {
+		return fmt.Errorf("%w: bad Cmp2", ErrBadRecord)
+	}
+	index, key1, key2, err := scanIndex(tdef, sc)
+	if err != nil {
+		return err
+	}
+	prefix := tdef.Prefix
+	if index >= 0 {
+		prefix = tdef.IndexPrefixes[index]
+	}
+	start, end := scanRange(prefix, key1, sc.Cmp1, key2, sc.Cmp2)
+	sc.kv, sc.tdef, sc.index, sc.err = kv, tdef, index, nil
+	sc.iter = kv.Scan(start, end)
+	return nil
+}
+
+// is the scanner at a row in the range?
+func (sc *Scanner) Valid() bool {
+	return sc.err == nil && sc.iter != nil && sc.iter.Valid()
+}
+
+// move to the next row
+func (sc *Scanner) Next() {
+	sc.iter.Next()
+}
+
+// the error that stopped the scan, if any
+func (sc *Scanner) Err() error {
+	if sc.err != nil || sc.iter == nil {
+		return sc.err
+	}
+	return sc.iter.Err()
+}
+
+// read the current row, the record gets all the columns.
+// the row of an index key is looked up by its primary key.
+func (sc *Scanner) Deref(rec *Record) error {
+	tdef := sc.tdef
+	key, val := sc.iter.Deref()
+	if sc.index >= 0 {
+		pkeys, err := indexPKeys(tdef, sc.index, key)
+		if err != nil {
+			sc.err = err
+			return err
+		}
+		key = encodeKey(tdef.Prefix, pkeys)
+		var ok bool
+		val, ok, err = sc.kv.Get(key)
+		if err == nil && !ok {
+			err = fmt.Errorf("%w: index of %s without a row", ErrBadData, tdef.Name)
+		}
+		if err != nil {
+			sc.err = err
+			return err
+		}
+	}
+	vals, err := decodeRowKV(tdef, key, val)
+	if err != nil {
+		sc.err = err
+		return err
+	}
+	rec.Cols = append([]string(nil), tdef.Cols...)
+	rec.Vals = vals
+	return nil
+}
+
+// release the version pinned by DB.Scan.
+// the scanner can't be used after that.
+func (sc *Scanner) Close() {
+	if sc.reader != nil {
+		sc.reader.EndRead()
+		sc.reader = nil
+	}
+}
+
+// scan a table, including the updates of the tx.
+// the scanner can't be used after the tx updates the table.
+func (tx *DBTX) Scan(table string, sc *Scanner) error {
+	tdef, err := getTableDef(tx.kv, tx.tables, table)
+	if err != nil {
+		return err
+	}
+	return scanStart(tx.kv, tdef, sc)
+}
+
+// scan the latest version of a table.
+// the version is pinned until the scanner is closed.
+func (db *DB) Scan(table string, sc *Scanner) error {
+	reader, err := db.kv.BeginRead()
+	if err != nil {
+		return err
+	}
+	tdef, err := getTableDef(reader, nil, table)
+	if err == nil {
+		err = scanStart(reader, tdef, sc)
+	}
+	if err != nil {
+		reader.EndRead()
+		return err
+	}
+	sc.reader = reader
+	return nil
+}
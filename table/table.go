@@ -0,0 +1,640 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/abedmohammed/goDB/btree"
+	"github.com/abedmohammed/goDB/tuple"
+)
+
+// a table keeps its rows in the KV tree of the database, under a prefix of its own.
+// the key is the primary key, the value is the other columns.
+// | prefix | primary key columns |  =>  | other columns |
+// |  4B BE |     tuple.Encode    |      | tuple.Encode  |
+// the definitions are rows of the internal table @table,
+// and @meta holds the next free prefix.
+type TableDef struct {
+	Name   string
+	Types  []uint32 // the column types
+	Cols   []string // the column names
+	PKeys  int      // the first PKeys columns are the primary key
+	Order  []string // the column names as declared, if they are not in the order of Cols
+	Prefix uint32   // assigned by TableNew
+	// the secondary indexes, see index.go
+	Indexes       [][]string // the declared columns of each index
+	Unique        []bool     // whether an index is unique, false if it's missing
+	IndexPrefixes []uint32   // assigned by TableNew and IndexNew
+}
+
+// the internal tables
+var TDEF_META = &TableDef{
+	Name:   "@meta",
+	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:   []string{"key", "val"},
+	PKeys:  1,
+	Prefix: 1,
+}
+
+var TDEF_TABLE = &TableDef{
+	Name:   "@table",
+	Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+	Cols:   []string{"name", "def"},
+	PKeys:  1,
+	Prefix: 2,
+}
+
+var INTERNAL_TABLES = map[string]*TableDef{
+	TDEF_META.Name:  TDEF_META,
+	TDEF_TABLE.Name: TDEF_TABLE,
+}
+
+// the prefixes below are reserved for the internal tables
+const TABLE_PREFIX_MIN = 100
+
+// the @meta key of the next free prefix
+const META_NEXT_PREFIX = "next_prefix"
+
+// the keys read at a time by the updates of a range of keys,
+// as the iterator can't be used while the tree is updated
+const SCAN_BATCH = 1000
+
+// a database of tables on top of a KV
+type DB struct {
+	Path    string
+	Options btree.Options
+	// internals
+	kv btree.KV
+}
+
+// the reads of a KV transaction or snapshot
+type kvReader interface {
+	Get(key []byte) ([]byte, bool, error)
+	Scan(start []byte, end []byte) *btree.KVIter
+}
+
+func (db *DB) Open() error {
+	db.kv.Path = db.Path
+	db.kv.Options = db.Options
+	return db.kv.Open()
+}
+
+func (db *DB) Close() error {
+	return db.kv.Close()
+}
+
+// a transaction over the tables, see btree.KVTX
+type DBTX struct {
+	db     *DB
+	kv     *btree.KVTX
+	tables map[string]*TableDef // the definitions read or updated by the tx
+}
+
+// begin a transaction
+func (db *DB) Begin() (*DBTX, error) {
+	kv, err := db.kv.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &DBTX{db: db, kv: kv, tables: map[string]*TableDef{}}, nil
+}
+
+// end a transaction
+func (tx *DBTX) Commit() error {
+	return tx.kv.Commit()
+}
+
+// end a transaction and discard its updates
+func (tx *DBTX) Abort() {
+	tx.kv.Abort()
+}
+
+// the definition of a table in the version that `kv` reads.
+// IndexNew changes definitions, so they are only cached for a transaction.
+func getTableDef(kv kvReader, cache map[string]*TableDef, name string) (*TableDef, error) {
+	if tdef, ok := INTERNAL_TABLES[name]; ok {
+		return tdef, nil
+	}
+	if tdef, ok := cache[name]; ok {
+		return tdef, nil
+	}
+	rec := (&Record{}).AddBytes("name", []byte(name))
+	ok, err := dbGet(kv, TDEF_TABLE, rec)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	tdef := &TableDef{}
+	if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrBadData, name, err)
+	}
+	if len(tdef.Indexes) != len(tdef.IndexPrefixes) {
+		return nil, fmt.Errorf("%w: table %s: bad indexes", ErrBadData, name)
+	}
+	if cache != nil {
+		cache[name] = tdef
+	}
+	return tdef, nil
+}
+
+// check a new table definition
+func tableDefCheck(tdef *TableDef) error {
+	if tdef.Name == "" || strings.HasPrefix(tdef.Name, "@") {
+		return fmt.Errorf("%w: bad table name %q", ErrBadTableDef, tdef.Name)
+	}
+	if len(tdef.Cols) == 0 || len(tdef.Cols) != len(tdef.Types) {
+		return fmt.Errorf("%w: bad columns", ErrBadTableDef)
+	}
+	if tdef.PKeys < 1 || tdef.PKeys > len(tdef.Cols) {
+		return fmt.Errorf("%w: bad primary key", ErrBadTableDef)
+	}
+	seen := map[string]bool{}
+	for i, col := range tdef.Cols {
+		if col == "" || seen[col] {
+			return fmt.Errorf("%w: bad column name %q", ErrBadTableDef, col)
+		}
+		seen[col] = true
+		if tdef.Types[i] == TYPE_ERROR || tdef.Types[i] > TYPE_BOOL {
+			return fmt.Errorf("%w: bad type of column %s", ErrBadTableDef, col)
+		}
+	}
+	if tdef.Order != nil {
+		// the same columns
+		for _, col := range tdef.Order {
+			if !seen[col] {
+				return fmt.Errorf("%w: bad column order", ErrBadTableDef)
+			}
+			delete(seen, col)
+		}
+		if len(seen) != 0 {
+			return fmt.Errorf("%w: bad column order", ErrBadTableDef)
+		}
+	}
+	return nil
+}
+
+// allocate n consecutive key prefixes
+func allocPrefixes(tx *DBTX, n int) (uint32, error) {
+	meta := (&Record{}).AddBytes("key", []byte(META_NEXT_PREFIX))
+	ok, err := dbGet(tx.kv, TDEF_META, meta)
+	if err != nil {
+		return 0, err
+	}
+	prefix := uint32(TABLE_PREFIX_MIN)
+	if ok {
+		val := meta.Get("val").Str
+		if len(val) != 4 {
+			return 0, fmt.Errorf("%w: bad %s", ErrBadData, META_NEXT_PREFIX)
+		}
+		prefix = binary.LittleEndian.Uint32(val)
+	}
+	meta = (&Record{}).AddBytes("key", []byte(META_NEXT_PREFIX)).
+		AddBytes("val", binary.LittleEndian.AppendUint32(nil, prefix+uint32(n)))
+	if _, err := dbUpdate(tx, TDEF_META, meta, btree.MODE_UPSERT); err != nil {
+		return 0, err
+	}
+	return prefix, nil
+}
+
+// store a new or updated definition in @table
+func saveTableDef(tx *DBTX, tdef *TableDef) error {
+	data, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	rec := (&Record{}).AddBytes("name", []byte(tdef.Name)).AddBytes("def", data)
+	if _, err := dbUpdate(tx, TDEF_TABLE, rec, btree.MODE_UPSERT); err != nil {
+		return err
+	}
+	tx.tables[tdef.Name] = tdef
+	return nil
+}
+
+// create a table with the indexes of its definition, the prefixes are assigned here
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+	if err := tableDefCheck(tdef); err != nil {
+		return err
+	}
+	def := *tdef
+	def.Types = append([]uint32(nil), tdef.Types...)
+	def.Cols = append([]string(nil), tdef.Cols...)
+	if len(tdef.Unique) > len(tdef.Indexes) {
+		return fmt.Errorf("%w: more unique flags than indexes", ErrBadTableDef)
+	}
+	def.Indexes, def.Unique = nil, nil
+	for i, cols := range tdef.Indexes {
+		index, err := indexNormalize(&def, cols)
+		if err != nil {
+			return err
+		}
+		if indexFind(&def, index) >= 0 {
+			return fmt.Errorf("%w: %v", ErrIndexExists, cols)
+		}
+		def.Indexes = append(def.Indexes, append([]string(nil), cols...))
+		def.Unique = append(def.Unique, indexUnique(tdef, i))
+	}
+	_, err := getTableDef(tx.kv, tx.tables, tdef.Name)
+	if err == nil {
+		return fmt.Errorf("%w: %s", ErrTableExists, tdef.Name)
+	}
+	if !errors.Is(err, ErrTableNotFound) {
+		return err
+	}
+	prefix, err := allocPrefixes(tx, 1+len(def.Indexes))
+	if err != nil {
+		return err
+	}
+	def.Prefix = prefix
+	def.IndexPrefixes = nil
+	for i := range def.Indexes {
+		def.IndexPrefixes = append(def.IndexPrefixes, prefix+1+uint32(i))
+	}
+	return saveTableDef(tx, &def)
+}
+
+// delete a table with its rows and indexes
+func (tx *DBTX) TableDrop(table string) error {
+	tdef, err := writableTable(tx, table)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range append([]uint32{tdef.Prefix}, tdef.IndexPrefixes...) {
+		start := binary.BigEndian.AppendUint32(nil, prefix)
+		if err := deleteRange(tx, start, tuple.PrefixEnd(start)); err != nil {
+			return err
+		}
+	}
+	rec := (&Record{}).AddBytes("name", []byte(table))
+	if _, err := dbDelete(tx, TDEF_TABLE, rec); err != nil {
+		return err
+	}
+	delete(tx.tables, table)
+	return nil
+}
+
+// delete the keys in [start, end), SCAN_BATCH at a time
+func deleteRange(tx *DBTX, start []byte, end []byte) error {
+	for {
+		keys := [][]byte{}
+		iter := tx.kv.Scan(start, end)
+		for ; iter.Valid() && len(keys) < SCAN_BATCH; iter.Next() {
+			key, _ := iter.Deref()
+			keys = append(keys, bytes.Clone(key))
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, key := range keys {
+			if _, err := tx.kv.Del(key); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// the definition of a table, it must not be modified
+func (tx *DBTX) TableDef(table string) (*TableDef, error) {
+	return getTableDef(tx.kv, tx.tables, table)
+}
+
+// the values of a record in the column order of the table.
+// the first n columns must be in it, the other ones are optional.
+func checkRecord(tdef *TableDef, rec *Record, n int) ([]Value, error) {
+	if len(rec.Cols) != len(rec.Vals) {
+		return nil, fmt.Errorf("%w: %d columns, %d values", ErrBadRecord, len(rec.Cols), len(rec.Vals))
+	}
+	vals := make([]Value, len(tdef.Cols))
+	for i, col := range rec.Cols {
+		idx := colIndex(tdef, col)
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: unknown column %s", ErrBadRecord, col)
+		}
+		if vals[idx].Type != TYPE_ERROR {
+			return nil, fmt.Errorf("%w: duplicate column %s", ErrBadRecord, col)
+		}
+		if rec.Vals[i].Type != tdef.Types[idx] {
+			return nil, fmt.Errorf("%w: bad type of column %s", ErrBadRecord, col)
+		}
+		vals[idx] = rec.Vals[i]
+	}
+	for i := 0; i < n; i++ {
+		if vals[i].Type == TYPE_ERROR {
+			return nil, fmt.Errorf("%w: missing column %s", ErrBadRecord, tdef.Cols[i])
+		}
+	}
+	return vals, nil
+}
+
+// the index of a column, -1 if there's none
+func colIndex(tdef *TableDef, col string) int {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
+// the KV key of a row
+func encodeKey(prefix uint32, pkeys []Value) []byte {
+	return tuple.Encode(binary.BigEndian.AppendUint32(nil, prefix), pkeys)
+}
+
+// read a row by its primary key, the record gets all the columns
+func dbGet(kv kvReader, tdef *TableDef, rec *Record) (bool, error) {
+	vals, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	val, ok, err := kv.Get(encodeKey(tdef.Prefix, vals[:tdef.PKeys]))
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := decodeRow(tdef, val, vals); err != nil {
+		return false, err
+	}
+	rec.Cols = append([]string(nil), tdef.Cols...)
+	rec.Vals = vals
+	return true, nil
+}
+
+// decode the KV value of a row into the columns after the primary key
+func decodeRow(tdef *TableDef, val []byte, vals []Value) error {
+	for i := tdef.PKeys; i < len(vals); i++ {
+		vals[i] = Value{Type: tdef.Types[i]}
+	}
+	if err := decodeValues(val, vals[tdef.PKeys:]); err != nil {
+		return fmt.Errorf("table %s: %w", tdef.Name, err)
+	}
+	return nil
+}
+
+// the columns of the row with the primary key of `vals`, nil if there's none
+func getOldRow(tx *DBTX, tdef *TableDef, key []byte, vals []Value) ([]Value, error) {
+	val, ok, err := tx.kv.Get(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return decodeOldRow(tdef, val, vals)
+}
+
+// the columns of a row from its KV value and the primary key of `vals`
+func decodeOldRow(tdef *TableDef, val []byte, vals []Value) ([]Value, error) {
+	old := make([]Value, len(tdef.Cols))
+	copy(old, vals[:tdef.PKeys])
+	if err := decodeRow(tdef, val, old); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// write a whole row, returns false if the mode doesn't allow it.
+// the modes are the ones of btree.UpdateReq, which also gives the old row.
+// the indexes are checked after the row is written, which is undone if they fail.
+func dbUpdate(tx *DBTX, tdef *TableDef, rec *Record, mode int) (bool, error) {
+	vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return false, err
+	}
+	req := &btree.UpdateReq{
+		Key:  encodeKey(tdef.Prefix, vals[:tdef.PKeys]),
+		Val:  tuple.Encode(nil, vals[tdef.PKeys:]),
+		Mode: mode,
+	}
+	if _, err := tx.kv.Update(req); err != nil {
+		return false, err
+	}
+	if !req.Updated {
+		// not allowed, or the same row
+		return req.Old != nil && mode != btree.MODE_INSERT_ONLY, nil
+	}
+	var old []Value
+	if !req.Added {
+		old, err = decodeOldRow(tdef, req.Old, vals)
+	}
+	if err == nil {
+		err = indexCheck(tx, tdef, old, vals)
+	}
+	if err != nil {
+		return false, dbUndo(tx, req, err)
+	}
+	if err := indexUpdate(tx, tdef, old, vals); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// put back the row replaced by an update, returns the error that stopped it
+func dbUndo(tx *DBTX, req *btree.UpdateReq, err error) error {
+	var e error
+	if req.Added {
+		_, e = tx.kv.Del(req.Key)
+	} else {
+		e = tx.kv.Set(req.Key, req.Old)
+	}
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+// delete a row by its primary key
+func dbDelete(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
+	vals, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	key := encodeKey(tdef.Prefix, vals[:tdef.PKeys])
+	old, err := getOldRow(tx, tdef, key, vals)
+	if err != nil || old == nil {
+		return false, err
+	}
+	if _, err := tx.kv.Del(key); err != nil {
+		return false, err
+	}
+	if err := indexUpdate(tx, tdef, old, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// the definition of a table that can be updated
+func writableTable(tx *DBTX, table string) (*TableDef, error) {
+	if _, ok := INTERNAL_TABLES[table]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrInternalTable, table)
+	}
+	return getTableDef(tx.kv, tx.tables, table)
+}
+
+// read a row by the primary key in `rec`, which gets all the columns
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+	tdef, err := getTableDef(tx.kv, tx.tables, table)
+	if err != nil {
+		return false, err
+	}
+	return dbGet(tx.kv, tdef, rec)
+}
+
+// add a row, returns false if the primary key exists.
+// the updates fail with ErrDuplicateKey if a unique index has the values of another row.
+func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
+	return txUpdate(tx, table, &rec, btree.MODE_INSERT_ONLY)
+}
+
+// replace a row, returns false if the primary key doesn't exist
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+	return txUpdate(tx, table, &rec, btree.MODE_UPDATE_ONLY)
+}
+
+// add or replace a row
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+	return txUpdate(tx, table, &rec, btree.MODE_UPSERT)
+}
+
+func txUpdate(tx *DBTX, table string, rec *Record, mode int) (bool, error) {
+	tdef, err := writableTable(tx, table)
+	if err != nil {
+		return false, err
+	}
+	return dbUpdate(tx, tdef, rec, mode)
+}
+
+// delete a row by its primary key, returns false if it doesn't exist
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	tdef, err := writableTable(tx, table)
+	if err != nil {
+		return false, err
+	}
+	return dbDelete(tx, tdef, &rec)
+}
+
+// create a table in a transaction of its own
+func (db *DB) TableNew(tdef *TableDef) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.TableNew(tdef); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// read a row from the latest version, see DBTX.Get
+func (db *DB) Get(table string, rec *Record) (bool, error) {
+	reader, err := db.kv.BeginRead()
+	if err != nil {
+		return false, err
+	}
+	defer reader.EndRead()
+	tdef, err := getTableDef(reader, nil, table)
+	if err != nil {
+		return false, err
+	}
+	return dbGet(reader, tdef, rec)
+}
+
+func (db *DB) Insert(table string, rec Record) (bool, error) {
+	return dbUpdateTX(db, table, &rec, btree.MODE_INSERT_ONLY)
+}
+
+func (db *DB) Update(table string, rec Record) (bool, error) {
+	return dbUpdateTX(db, table, &rec, btree.MODE_UPDATE_ONLY)
+}
+
+func (db *DB) Upsert(table string, rec Record) (bool, error) {
+	return dbUpdateTX(db, table, &rec, btree.MODE_UPSERT)
+}
+
+// update a row in a transaction of its own
+func dbUpdateTX(db *DB, table string, rec *Record, mode int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	ok, err := txUpdate(tx, table, rec, mode)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return ok, tx.Commit()
+}
+
+func (db *DB) Delete(table string, rec Record) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	deleted, err := tx.Delete(table, rec)
+	if err != nil {
+		tx.Abort()
+		return false, err
+	}
+	return deleted, tx.Commit()
+}
+
+// delete a table in a transaction of its own
+func (db *DB) TableDrop(table string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.TableDrop(table); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// a read-only snapshot of the tables, see btree.KVReader
+type DBReader struct {
+	kv     *btree.KVReader
+	tables map[string]*TableDef // the definitions read so far
+}
+
+// begin a snapshot of the latest version
+func (db *DB) BeginRead() (*DBReader, error) {
+	kv, err := db.kv.BeginRead()
+	if err != nil {
+		return nil, err
+	}
+	return &DBReader{kv: kv, tables: map[string]*TableDef{}}, nil
+}
+
+// end the snapshot, its scanners can't be used after that
+func (reader *DBReader) EndRead() {
+	reader.kv.EndRead()
+}
+
+// the definition of a table, it must not be modified
+func (reader *DBReader) TableDef(table string) (*TableDef, error) {
+	return getTableDef(reader.kv, reader.tables, table)
+}
+
+// read a row of the snapshot, see DBTX.Get
+func (reader *DBReader) Get(table string, rec *Record) (bool, error) {
+	tdef, err := reader.TableDef(table)
+	if err != nil {
+		return false, err
+	}
+	return dbGet(reader.kv, tdef, rec)
+}
+
+// scan a table of the snapshot
+func (reader *DBReader) Scan(table string, sc *Scanner) error {
+	tdef, err := reader.TableDef(table)
+	if err != nil {
+		return err
+	}
+	return scanStart(reader.kv, tdef, sc)
+}
@@ -0,0 +1,98 @@
+package table
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func testOpen(t *testing.T) (*DB, string) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := &DB{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+func TestTable(t *testing.T) {
+	db, path := testOpen(t)
+	tdef := &TableDef{
+		Name:  "t",
+		Types: []uint32{TYPE_INT64, TYPE_STRING, TYPE_FLOAT64, TYPE_BOOL, TYPE_BYTES},
+		Cols:  []string{"id", "name", "score", "ok", "data"},
+		PKeys: 1,
+	}
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TableNew(tdef); !errors.Is(err, ErrTableExists) {
+		t.Fatal("table exists", err)
+	}
+	rec := (&Record{}).AddStr("name", "a\x00b").AddInt64("id", -5).AddFloat64("score", -1.5).AddBool("ok", true).AddBytes("data", []byte{0, 1, 2})
+	if ok, err := db.Insert("t", *rec); !ok || err != nil {
+		t.Fatal("insert", ok, err)
+	}
+	if ok, err := db.Insert("t", *rec); ok || err != nil {
+		t.Fatal("insert again", ok, err)
+	}
+	missing := (&Record{}).AddInt64("id", 7).AddStr("name", "").AddFloat64("score", 0).AddBool("ok", false).AddBytes("data", nil)
+	if ok, err := db.Update("t", *missing); ok || err != nil {
+		t.Fatal("update a missing row", ok, err)
+	}
+	if _, err := db.Insert("t", *(&Record{}).AddInt64("id", 1)); !errors.Is(err, ErrBadRecord) {
+		t.Fatal("missing columns", err)
+	}
+	if _, err := db.Insert("@meta", *(&Record{}).AddBytes("key", nil).AddBytes("val", nil)); !errors.Is(err, ErrInternalTable) {
+		t.Fatal("internal table", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = &DB{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got := (&Record{}).AddInt64("id", -5)
+	if ok, err := db.Get("t", got); !ok || err != nil {
+		t.Fatal("get", ok, err)
+	}
+	if string(got.Get("name").Str) != "a\x00b" || got.Get("score").F64 != -1.5 || !got.Get("ok").Bool || string(got.Get("data").Str) != "\x00\x01\x02" {
+		t.Fatalf("bad row %+v", got)
+	}
+	// an aborted table doesn't take a prefix
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udef := &TableDef{Name: "u", Types: []uint32{TYPE_BYTES}, Cols: []string{"k"}, PKeys: 1}
+	if err := tx.TableNew(udef); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tx.Insert("u", *(&Record{}).AddBytes("k", []byte("x"))); !ok || err != nil {
+		t.Fatal("insert", ok, err)
+	}
+	tx.Abort()
+	if _, err := db.Get("u", (&Record{}).AddBytes("k", []byte("x"))); !errors.Is(err, ErrTableNotFound) {
+		t.Fatal("aborted table", err)
+	}
+	if err := db.TableNew(udef); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Delete("t", *(&Record{}).AddInt64("id", -5)); !ok || err != nil {
+		t.Fatal("delete", ok, err)
+	}
+	if ok, _ := db.Get("t", (&Record{}).AddInt64("id", -5)); ok {
+		t.Fatal("deleted row")
+	}
+	reader, err := db.kv.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.EndRead()
+	if udef, err := getTableDef(reader, nil, "u"); err != nil || udef.Prefix != TABLE_PREFIX_MIN+1 {
+		t.Fatal("bad prefix", err)
+	}
+}
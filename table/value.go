@@ -0,0 +1,85 @@
+package table
+
+import (
+	"fmt"
+
+	"github.com/abedmohammed/goDB/tuple"
+)
+
+// the column types, see the tuple package
+const (
+	TYPE_ERROR   = tuple.TYPE_ERROR
+	TYPE_BYTES   = tuple.TYPE_BYTES
+	TYPE_INT64   = tuple.TYPE_INT64
+	TYPE_STRING  = tuple.TYPE_STRING
+	TYPE_FLOAT64 = tuple.TYPE_FLOAT64
+	TYPE_BOOL    = tuple.TYPE_BOOL
+)
+
+// a column value, only the field of its type is used.
+// strings are kept in Str like bytes.
+type Value = tuple.Value
+
+// a row or a part of it, the columns can be in any order
+type Record struct {
+	Cols []string
+	Vals []Value
+}
+
+func (rec *Record) AddBytes(col string, val []byte) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BYTES, Str: val})
+	return rec
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+	return rec
+}
+
+func (rec *Record) AddStr(col string, val string) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_STRING, Str: []byte(val)})
+	return rec
+}
+
+func (rec *Record) AddFloat64(col string, val float64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_FLOAT64, F64: val})
+	return rec
+}
+
+func (rec *Record) AddBool(col string, val bool) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BOOL, Bool: val})
+	return rec
+}
+
+// the value of a column, nil if it's not in the record
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
+
+// decode the columns of a row into `out`, whose types are set
+func decodeValues(in []byte, out []Value) error {
+	vals, err := tuple.Decode(in)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadData, err)
+	}
+	if len(vals) != len(out) {
+		return fmt.Errorf("%w: %d columns, want %d", ErrBadData, len(vals), len(out))
+	}
+	for i := range out {
+		if vals[i].Type != out[i].Type {
+			return fmt.Errorf("%w: bad type of column %d", ErrBadData, i)
+		}
+		out[i] = vals[i]
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package tuple
+
+import "errors"
+
+// the error returned for bytes that aren't an encoded tuple.
+// it can be wrapped with more context, match it with errors.Is.
+var ErrBadTuple = errors.New("Bad tuple encoding")
@@ -0,0 +1,184 @@
+package tuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// the value types
+const (
+	TYPE_ERROR   = 0 // not a valid type
+	TYPE_BYTES   = 1
+	TYPE_INT64   = 2
+	TYPE_STRING  = 3
+	TYPE_FLOAT64 = 4
+	TYPE_BOOL    = 5
+	TYPE_NULL    = 6
+)
+
+// a value of a tuple, only the field of its type is used.
+// strings are kept in Str like bytes.
+type Value struct {
+	Type uint32
+	I64  int64
+	Str  []byte
+	F64  float64
+	Bool bool
+}
+
+// a tuple is encoded so that the encoded bytes compare like the values,
+// column by column, with bytes.Compare. each value starts with a tag byte:
+// | tag | int64 | float64 | bool |      bytes & string      |
+// | 1B  | 8B BE | 8B BE   |  1B  | escaped, then a 0 byte   |
+// the tag of NULL is 0 so it sorts first, it has no payload.
+// the sign bit of an int64 is flipped, so negative numbers sort first.
+// a float64 has its sign bit flipped, and all its bits if it's negative.
+// the 0 bytes of a string are escaped, so its 0 terminator sorts before
+// the bytes of the longer strings it's a prefix of.
+const TAG_NULL = 0
+
+// the tag byte of a type
+func typeTag(typ uint32) byte {
+	if typ == TYPE_NULL {
+		return TAG_NULL
+	}
+	return byte(typ)
+}
+
+// append the encoded values to out
+func Encode(out []byte, vals []Value) []byte {
+	for _, v := range vals {
+		out = append(out, typeTag(v.Type))
+		switch v.Type {
+		case TYPE_NULL:
+		case TYPE_INT64:
+			out = binary.BigEndian.AppendUint64(out, uint64(v.I64)^(1<<63))
+		case TYPE_FLOAT64:
+			bits := math.Float64bits(v.F64)
+			if v.F64 == 0 {
+				bits = 0 // -0 is 0
+			}
+			if bits&(1<<63) != 0 {
+				bits = ^bits
+			} else {
+				bits ^= 1 << 63
+			}
+			out = binary.BigEndian.AppendUint64(out, bits)
+		case TYPE_BOOL:
+			if v.Bool {
+				out = append(out, 1)
+			} else {
+				out = append(out, 0)
+			}
+		case TYPE_BYTES, TYPE_STRING:
+			out = append(escapeString(out, v.Str), 0)
+		default:
+			panic("tuple.Encode: bad type")
+		}
+	}
+	return out
+}
+
+// decode all the values of an encoded tuple
+func Decode(in []byte) ([]Value, error) {
+	vals := []Value{}
+	for len(in) > 0 {
+		v, rest, err := DecodeOne(in)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+		in = rest
+	}
+	return vals, nil
+}
+
+// decode the first value of an encoded tuple, returns the rest of it
+func DecodeOne(in []byte) (Value, []byte, error) {
+	if len(in) == 0 {
+		return Value{}, nil, fmt.Errorf("%w: empty", ErrBadTuple)
+	}
+	v := Value{Type: uint32(in[0])}
+	in = in[1:]
+	switch v.Type {
+	case TAG_NULL:
+		v.Type = TYPE_NULL
+	case TYPE_INT64, TYPE_FLOAT64:
+		if len(in) < 8 {
+			return Value{}, nil, fmt.Errorf("%w: short value", ErrBadTuple)
+		}
+		bits := binary.BigEndian.Uint64(in)
+		if v.Type == TYPE_INT64 {
+			v.I64 = int64(bits ^ (1 << 63))
+		} else if bits&(1<<63) != 0 {
+			v.F64 = math.Float64frombits(bits ^ (1 << 63))
+		} else {
+			v.F64 = math.Float64frombits(^bits)
+		}
+		in = in[8:]
+	case TYPE_BOOL:
+		if len(in) < 1 || in[0] > 1 {
+			return Value{}, nil, fmt.Errorf("%w: bad bool", ErrBadTuple)
+		}
+		v.Bool = in[0] == 1
+		in = in[1:]
+	case TYPE_BYTES, TYPE_STRING:
+		end := bytes.IndexByte(in, 0)
+		if end < 0 {
+			return Value{}, nil, fmt.Errorf("%w: unterminated string", ErrBadTuple)
+		}
+		str, err := unescapeString(in[:end])
+		if err != nil {
+			return Value{}, nil, err
+		}
+		v.Str = str
+		in = in[end+1:]
+	default:
+		return Value{}, nil, fmt.Errorf("%w: bad tag %d", ErrBadTuple, v.Type)
+	}
+	return v, in, nil
+}
+
+// the smallest key after all the keys starting with the prefix,
+// for a scan of [prefix, PrefixEnd(prefix)). nil if there's none.
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// 0x00 is written as 0x01 0x01 and 0x01 as 0x01 0x02,
+// so a string has no 0 byte and still sorts the same
+func escapeString(out []byte, in []byte) []byte {
+	for _, ch := range in {
+		if ch <= 1 {
+			out = append(out, 0x01, ch+1)
+		} else {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
+
+func unescapeString(in []byte) ([]byte, error) {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] != 0x01 {
+			out = append(out, in[i])
+			continue
+		}
+		if i+1 >= len(in) || (in[i+1] != 1 && in[i+1] != 2) {
+			return nil, fmt.Errorf("%w: bad escape", ErrBadTuple)
+		}
+		out = append(out, in[i+1]-1)
+		i++
+	}
+	return out, nil
+}
@@ -0,0 +1,108 @@
+package tuple
+
+import (
+	"bytes"
+	"cmp"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// the order of the values, NULL first, then by type tag
+func valueCompare(a Value, b Value) int {
+	if a.Type != b.Type {
+		return cmp.Compare(typeTag(a.Type), typeTag(b.Type))
+	}
+	switch a.Type {
+	case TYPE_INT64:
+		return cmp.Compare(a.I64, b.I64)
+	case TYPE_FLOAT64:
+		return cmp.Compare(a.F64, b.F64)
+	case TYPE_BOOL:
+		return cmp.Compare(boolInt(a.Bool), boolInt(b.Bool))
+	case TYPE_BYTES, TYPE_STRING:
+		return bytes.Compare(a.Str, b.Str)
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// tuples are compared column by column, a prefix goes first
+func tupleCompare(a []Value, b []Value) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := valueCompare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func randValue(r *rand.Rand, typ uint32) Value {
+	if r.Intn(8) == 0 {
+		return Value{Type: TYPE_NULL}
+	}
+	v := Value{Type: typ}
+	switch typ {
+	case TYPE_INT64:
+		v.I64 = []int64{math.MinInt64, -1, 0, 1, math.MaxInt64, r.Int63() - r.Int63()}[r.Intn(6)]
+	case TYPE_FLOAT64:
+		v.F64 = []float64{math.Inf(-1), -1.5, 0, 2.25, math.Inf(1), r.NormFloat64() * 1e6, -math.SmallestNonzeroFloat64}[r.Intn(7)]
+	case TYPE_BOOL:
+		v.Bool = r.Intn(2) == 0
+	default:
+		// the bytes that are escaped
+		v.Str = make([]byte, r.Intn(4))
+		for i := range v.Str {
+			v.Str[i] = []byte{0, 1, 2, 0xff, 'a'}[r.Intn(5)]
+		}
+	}
+	return v
+}
+
+func TestTuple(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	types := []uint32{TYPE_INT64, TYPE_STRING, TYPE_FLOAT64, TYPE_BOOL, TYPE_BYTES}
+	tuples := [][]Value{}
+	for i := 0; i < 3000; i++ {
+		tup := []Value{}
+		for j := r.Intn(len(types) + 1); j > 0; j-- {
+			tup = append(tup, randValue(r, types[len(tup)]))
+		}
+		tuples = append(tuples, tup)
+	}
+	for _, tup := range tuples {
+		dec, err := Decode(Encode(nil, tup))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tupleCompare(dec, tup) != 0 {
+			t.Fatalf("decoded %v, not %v", dec, tup)
+		}
+	}
+	// the encoded tuples are in the same order
+	sort.Slice(tuples, func(i, j int) bool { return tupleCompare(tuples[i], tuples[j]) < 0 })
+	for i := 1; i < len(tuples); i++ {
+		c := tupleCompare(tuples[i-1], tuples[i])
+		enc := bytes.Compare(Encode(nil, tuples[i-1]), Encode(nil, tuples[i]))
+		if c != enc {
+			t.Fatalf("%v %v: %d, encoded %d", tuples[i-1], tuples[i], c, enc)
+		}
+	}
+	negZero := []Value{{Type: TYPE_FLOAT64, F64: math.Copysign(0, -1)}}
+	if !bytes.Equal(Encode(nil, negZero), Encode(nil, []Value{{Type: TYPE_FLOAT64}})) {
+		t.Fatal("-0 is not 0")
+	}
+	if string(PrefixEnd([]byte{1, 0xff})) != "\x02" || PrefixEnd([]byte{0xff}) != nil {
+		t.Fatal("bad PrefixEnd")
+	}
+	if _, err := Decode([]byte{9}); err == nil {
+		t.Fatal("decoded a bad tag")
+	}
+}